@@ -0,0 +1,325 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+const apiKeyPrefix = "glk_"
+
+var ErrDuplicateAPIKeyName = errors.New("duplicate api key name")
+
+type APIKey struct {
+	ID          int64      `json:"id"`
+	UserID      int64      `json:"-"`
+	Name        string     `json:"name"`
+	Plaintext   string     `json:"key,omitempty"`
+	Prefix      string     `json:"prefix"`
+	Hash        []byte     `json:"-"`
+	Permissions []string   `json:"permissions"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Expiry      *time.Time `json:"expiry,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	Version     int        `json:"version"`
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+func generateAPIKey(userID int64, name string, expiry *time.Time, permissions []string) (*APIKey, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := apiKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	hash := sha256.Sum256([]byte(plaintext))
+
+	return &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Plaintext:   plaintext,
+		Prefix:      plaintext[:len(apiKeyPrefix)+6],
+		Hash:        hash[:],
+		Permissions: permissions,
+		Expiry:      expiry,
+	}, nil
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, key string) {
+	v.Check(key != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(key, apiKeyPrefix), "key", "must be a valid api key")
+	v.Check(len(key) == len(apiKeyPrefix)+52, "key", "must be a valid api key")
+}
+
+// ValidateAPIKey checks the fields of key except its expiry, which is only
+// checked with ValidateAPIKeyExpiry when it is set or changed, so an expired
+// key can still be renamed.
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// ValidateAPIKeyExpiry checks a new expiry, nil means the key never expires.
+func ValidateAPIKeyExpiry(v *validator.Validator, expiry *time.Time) {
+	if expiry != nil {
+		v.Check(expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+func (m APIKeyModel) New(userID int64, name string, expiry *time.Time, permissions []string) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, expiry, permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(key)
+	return key, err
+}
+
+func (m APIKeyModel) Insert(key *APIKey) error {
+	stmt := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, version
+	`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&key.ID, &key.CreatedAt, &key.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "api_keys_user_id_name_key"`:
+			return ErrDuplicateAPIKeyName
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m APIKeyModel) GetForUser(id, userID int64) (*APIKey, error) {
+	if id < 1 {
+		return nil, ErrRecoredNotFound
+	}
+
+	query := `
+		SELECT id, user_id, name, prefix, permissions, created_at, expiry, last_used_at, version
+		FROM api_keys
+		WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var key APIKey
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.CreatedAt,
+		&key.Expiry,
+		&key.LastUsedAt,
+		&key.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &key, nil
+}
+
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, user_id, name, prefix, permissions, created_at, expiry, last_used_at, version
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.CreatedAt,
+			&key.Expiry,
+			&key.LastUsedAt,
+			&key.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetWithUser resolves an unexpired api key and its owner in a single query.
+func (m APIKeyModel) GetWithUser(plaintext string) (*APIKey, *User, error) {
+	keyHash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT api_keys.id, api_keys.user_id, api_keys.name, api_keys.prefix, api_keys.permissions,
+			api_keys.created_at, api_keys.expiry, api_keys.last_used_at, api_keys.version,
+			users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locked, users.version
+		FROM api_keys
+		INNER JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1
+		AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var key APIKey
+	var user User
+
+	err := m.DB.QueryRowContext(ctx, query, keyHash[:], time.Now()).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.CreatedAt,
+		&key.Expiry,
+		&key.LastUsedAt,
+		&key.Version,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locked,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecoredNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &key, &user, nil
+}
+
+func (m APIKeyModel) Update(key *APIKey) error {
+	stmt := `
+		UPDATE api_keys
+		SET name = $1, permissions = $2, expiry = $3, version = version + 1
+		WHERE id = $4 AND user_id = $5 AND version = $6
+		RETURNING version
+	`
+
+	args := []any{key.Name, pq.Array(key.Permissions), key.Expiry, key.ID, key.UserID, key.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&key.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "api_keys_user_id_name_key"`:
+			return ErrDuplicateAPIKeyName
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m APIKeyModel) DeleteForUser(id, userID int64) error {
+	stmt := `
+		DELETE
+		FROM api_keys
+		WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecoredNotFound
+	}
+
+	return nil
+}
+
+// Touch records the last time an api key was used. Callers are expected to
+// throttle it, it always issues a write.
+func (m APIKeyModel) Touch(id int64, lastUsed time.Time) error {
+	stmt := `
+		UPDATE api_keys
+		SET last_used_at = $1
+		WHERE id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, lastUsed, id)
+	return err
+}
@@ -0,0 +1,145 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrDuplicateIdentity = errors.New("duplicate identity")
+
+// Identity links a user to an account at an external OpenID provider, the
+// pair of issuer and subject is stable while the email may change.
+type Identity struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+func (m IdentityModel) Insert(identity *Identity) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertIdentity(ctx, m.DB, identity)
+}
+
+// Provision creates user with role and links identity to it in one
+// transaction, so a failure never leaves a user behind that the identity
+// provider can not log in to.
+func (m IdentityModel) Provision(user *User, role string, identity *Identity) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// a no-op once the transaction was committed
+	defer tx.Rollback()
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	err = addRolesForUser(ctx, tx, user.ID, role)
+	if err != nil {
+		return err
+	}
+
+	identity.UserID = user.ID
+
+	err = insertIdentity(ctx, tx, identity)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertIdentity(ctx context.Context, q querier, identity *Identity) error {
+	stmt := `
+		INSERT INTO user_identities (user_id, issuer, subject, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`
+
+	args := []any{identity.UserID, identity.Issuer, identity.Subject, identity.Email}
+
+	err := q.QueryRowContext(ctx, stmt, args...).Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "user_identities_issuer_subject_key"`:
+			return ErrDuplicateIdentity
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetUser returns the user linked to the external identity.
+func (m IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locked, users.version,
+			users.failed_login_attempts, users.last_failed_login_at, users.locked_until, users.language
+		FROM users
+		INNER JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	user := User{}
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locked,
+		&user.Version,
+		&user.FailedLoginAttempts,
+		&user.LastFailedLoginAt,
+		&user.LockedUntil,
+		&user.Language,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// UpdateEmail records the latest email the provider sent for the identity.
+func (m IdentityModel) UpdateEmail(issuer, subject, email string) error {
+	stmt := `
+		UPDATE user_identities
+		SET email = $3
+		WHERE issuer = $1 AND subject = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, issuer, subject, email)
+	return err
+}
@@ -11,17 +11,31 @@ var (
 )
 
 type Models struct {
-	Movies      MovideModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies        MovideModel
+	Users         UserModel
+	Tokens        TokenModel
+	Permissions   PermissionModel
+	APIKeys       APIKeyModel
+	Roles         RoleModel
+	TOTP          TOTPModel
+	OAuthClients  OAuthClientModel
+	Identities    IdentityModel
+	Outbox        OutboxModel
+	Notifications NotificationModel
 }
 
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies:      MovideModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:        MovideModel{DB: db},
+		Users:         UserModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		Roles:         RoleModel{DB: db},
+		TOTP:          TOTPModel{DB: db},
+		OAuthClients:  OAuthClientModel{DB: db},
+		Identities:    IdentityModel{DB: db},
+		Outbox:        OutboxModel{DB: db},
+		Notifications: NotificationModel{DB: db},
 	}
 }
@@ -19,6 +19,7 @@ type Movie struct {
 	Runtime   Runtime   `json:"runtime,omitempty"`
 	Genres    []string  `json:"genres,omitempty"`
 	Version   int32     `json:"version"`
+	CreatedBy *int64    `json:"created_by,omitempty"`
 }
 
 type MovideModel struct {
@@ -45,12 +46,12 @@ func ValidateMovie(validations *validator.Validator, movie *Movie) {
 
 func (m MovideModel) Insert(movie *Movie) error {
 	stmt := `
-			INSERT INTO movies (title, year, runtime, genres)
-			VALUES($1, $2, $3,$4)
+			INSERT INTO movies (title, year, runtime, genres, created_by)
+			VALUES($1, $2, $3, $4, $5)
 			RETURNING id, created_at, version
 	`
 
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy}
 
 	return m.DB.QueryRow(stmt, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
@@ -62,7 +63,7 @@ func (m MovideModel) Get(id int64) (*Movie, error) {
 	}
 
 	stmt := `
-			SELECT id, created_at, title, year, runtime, genres, version
+			SELECT id, created_at, title, year, runtime, genres, version, created_by
 			FROM movies
 			WHERE id = $1
 		`
@@ -81,6 +82,7 @@ func (m MovideModel) Get(id int64) (*Movie, error) {
 		&result.Runtime,
 		pq.Array(&result.Genres),
 		&result.Version,
+		&result.CreatedBy,
 	)
 
 	if err != nil {
@@ -162,7 +164,7 @@ func (m MovideModel) Delete(id int64) error {
 
 func (m MovideModel) GetAll(title string, genres []string, filrters Filters) ([]*Movie, Metadata, error) {
 	stmt := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT COUNT(*) OVER(), id, created_at, title, year, runtime, genres, version, created_by
 		FROM movies
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 		AND (genres @> $2 OR $2 = '{}')
@@ -204,6 +206,7 @@ func (m MovideModel) GetAll(title string, genres []string, filrters Filters) ([]
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.CreatedBy,
 		)
 
 		if err != nil {
@@ -220,3 +223,54 @@ func (m MovideModel) GetAll(title string, genres []string, filrters Filters) ([]
 	}
 	return movies, meta, nil
 }
+
+// GetCreatedSince returns up to limit movies added after since that share at
+// least one genre with genres, newest first.
+func (m MovideModel) GetCreatedSince(since time.Time, genres []string, limit int) ([]*Movie, error) {
+	stmt := `
+		SELECT id, created_at, title, year, runtime, genres, version, created_by
+		FROM movies
+		WHERE created_at > $1
+		AND genres && $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, since, pq.Array(genres), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.CreatedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
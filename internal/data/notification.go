@@ -0,0 +1,201 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+var DigestFrequencies = []string{DigestDaily, DigestWeekly}
+
+// NotificationPreferences controls the new-release digest emails of a user.
+// Users without stored preferences do not get digests.
+type NotificationPreferences struct {
+	UserID       int64      `json:"-"`
+	Genres       []string   `json:"genres"`
+	Frequency    string     `json:"frequency"`
+	OptedOut     bool       `json:"opted_out"`
+	LastDigestAt *time.Time `json:"last_digest_at,omitempty"`
+	Version      int        `json:"version"`
+}
+
+func DefaultNotificationPreferences(userID int64) *NotificationPreferences {
+	return &NotificationPreferences{
+		UserID:    userID,
+		Genres:    []string{},
+		Frequency: DigestWeekly,
+	}
+}
+
+func ValidateNotificationPreferences(v *validator.Validator, prefs *NotificationPreferences) {
+	v.Check(prefs.Genres != nil, "genres", "must be provided")
+	v.Check(len(prefs.Genres) <= 20, "genres", "must not contain more than 20 genres")
+	v.Check(validator.Unique(prefs.Genres), "genres", "must not contain duplicate values")
+
+	for _, genre := range prefs.Genres {
+		v.Check(genre != "" && len(genre) <= 100, "genres", "must contain genres between 1 and 100 bytes long")
+	}
+
+	v.Check(validator.In(prefs.Frequency, DigestFrequencies...), "frequency", "must be daily or weekly")
+}
+
+type NotificationModel struct {
+	DB *sql.DB
+}
+
+func (m NotificationModel) Get(userID int64) (*NotificationPreferences, error) {
+	query := `
+		SELECT user_id, genres, frequency, opted_out, last_digest_at, version
+		FROM notification_preferences
+		WHERE user_id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var prefs NotificationPreferences
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&prefs.UserID,
+		pq.Array(&prefs.Genres),
+		&prefs.Frequency,
+		&prefs.OptedOut,
+		&prefs.LastDigestAt,
+		&prefs.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &prefs, nil
+}
+
+// Save creates or updates the preferences. Version 0 means the preferences
+// were not stored yet, the first digest is sent one period after that.
+func (m NotificationModel) Save(prefs *NotificationPreferences) error {
+	stmt := `
+		INSERT INTO notification_preferences (user_id, genres, frequency, opted_out)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET genres = EXCLUDED.genres, frequency = EXCLUDED.frequency, opted_out = EXCLUDED.opted_out,
+			version = notification_preferences.version + 1
+		WHERE notification_preferences.version = $5
+		RETURNING last_digest_at, version
+	`
+
+	args := []any{prefs.UserID, pq.Array(prefs.Genres), prefs.Frequency, prefs.OptedOut, prefs.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&prefs.LastDigestAt, &prefs.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OptOut stops all digest emails of the user, whatever the stored version.
+func (m NotificationModel) OptOut(userID int64) error {
+	stmt := `
+		INSERT INTO notification_preferences (user_id, opted_out)
+		VALUES ($1, TRUE)
+		ON CONFLICT (user_id) DO UPDATE
+		SET opted_out = TRUE, version = notification_preferences.version + 1
+		WHERE NOT notification_preferences.opted_out
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, userID)
+	return err
+}
+
+// DigestRecipient is a user whose digest is due, Since is the time of the
+// previous digest.
+type DigestRecipient struct {
+	UserID    int64
+	Email     string
+	Name      string
+	Language  string
+	Genres    []string
+	Frequency string
+	Since     time.Time
+}
+
+// ClaimDue returns up to limit users whose digest is due and moves their
+// last digest time to now, so concurrent jobs never pick the same user.
+func (m NotificationModel) ClaimDue(limit int) ([]*DigestRecipient, error) {
+	stmt := `
+		WITH due AS (
+			SELECT notification_preferences.user_id, notification_preferences.last_digest_at
+			FROM notification_preferences
+			INNER JOIN users ON users.id = notification_preferences.user_id
+			WHERE NOT notification_preferences.opted_out
+			AND notification_preferences.genres <> '{}'
+			AND users.activated AND NOT users.locked
+			AND notification_preferences.last_digest_at <= NOW() - CASE notification_preferences.frequency
+				WHEN 'daily' THEN INTERVAL '1 day'
+				ELSE INTERVAL '7 days'
+			END
+			ORDER BY notification_preferences.last_digest_at
+			LIMIT $1
+			FOR UPDATE OF notification_preferences SKIP LOCKED
+		)
+		UPDATE notification_preferences
+		SET last_digest_at = NOW()
+		FROM due, users
+		WHERE notification_preferences.user_id = due.user_id AND users.id = due.user_id
+		RETURNING users.id, users.email, users.name, users.language,
+			notification_preferences.genres, notification_preferences.frequency, due.last_digest_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	recipients := []*DigestRecipient{}
+	for rows.Next() {
+		var r DigestRecipient
+
+		err := rows.Scan(&r.UserID, &r.Email, &r.Name, &r.Language, pq.Array(&r.Genres), &r.Frequency, &r.Since)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, &r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
@@ -0,0 +1,437 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+
+	oauthClientIDPrefix     = "glc_"
+	oauthClientSecretPrefix = "gls_"
+	oauthAccessTokenPrefix  = "glo_"
+)
+
+var OAuthGrantTypes = []string{GrantAuthorizationCode, GrantClientCredentials}
+
+// OAuthClient is a third-party application registered by a user. Public
+// clients have no secret and can only use the authorization code grant with
+// PKCE. Scopes are the permission codes the client may ever ask for.
+type OAuthClient struct {
+	ID           int64     `json:"id"`
+	ClientID     string    `json:"client_id"`
+	Secret       string    `json:"client_secret,omitempty"`
+	SecretHash   []byte    `json:"-"`
+	UserID       int64     `json:"-"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	GrantTypes   []string  `json:"grant_types"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+	Version      int       `json:"version"`
+}
+
+type OAuthClientModel struct {
+	DB *sql.DB
+}
+
+func randomOAuthString(prefix string) (string, error) {
+	randomBytes := make([]byte, 20)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)), nil
+}
+
+// SecretMatches reports whether secret belongs to a confidential client.
+func (c *OAuthClient) SecretMatches(secret string) bool {
+	if !c.Confidential || secret == "" {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+func (c *OAuthClient) AllowsGrant(grantType string) bool {
+	return slices.Contains(c.GrantTypes, grantType)
+}
+
+func (c *OAuthClient) AllowsRedirectURI(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+// ParseOAuthScope splits a space delimited oauth scope parameter into
+// permission codes.
+func ParseOAuthScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.GrantTypes) > 0, "grant_types", "must contain at least one grant type")
+	v.Check(validator.Unique(client.GrantTypes), "grant_types", "must not contain duplicate values")
+	for _, grant := range client.GrantTypes {
+		v.Check(validator.In(grant, OAuthGrantTypes...), "grant_types", "must only contain authorization_code or client_credentials")
+	}
+
+	if client.AllowsGrant(GrantClientCredentials) {
+		v.Check(client.Confidential, "grant_types", "client_credentials can only be used by confidential clients")
+	}
+
+	if client.AllowsGrant(GrantAuthorizationCode) {
+		v.Check(len(client.RedirectURIs) > 0, "redirect_uris", "must be provided for the authorization_code grant")
+	}
+
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	for _, uri := range client.RedirectURIs {
+		v.Check(validRedirectURI(uri), "redirect_uris", "must only contain absolute https urls without a fragment, or http urls on localhost")
+	}
+
+	v.Check(len(client.Scopes) > 0, "scopes", "must contain at least one permission code")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+}
+
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Fragment != "" || u.Host == "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return false
+	}
+}
+
+// New generates the client id, and a secret for confidential clients, and
+// inserts the client. The plaintext secret is only available on the returned
+// client.
+func (m OAuthClientModel) New(client *OAuthClient) error {
+	clientID, err := randomOAuthString(oauthClientIDPrefix)
+	if err != nil {
+		return err
+	}
+
+	client.ClientID = clientID
+
+	if client.Confidential {
+		secret, err := randomOAuthString(oauthClientSecretPrefix)
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.Sum256([]byte(secret))
+		client.Secret = secret
+		client.SecretHash = hash[:]
+	}
+
+	return m.Insert(client)
+}
+
+func (m OAuthClientModel) Insert(client *OAuthClient) error {
+	stmt := `
+		INSERT INTO oauth_clients (client_id, secret_hash, user_id, name, redirect_uris, grant_types, scopes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, version
+	`
+
+	args := []any{
+		client.ClientID,
+		client.SecretHash,
+		client.UserID,
+		client.Name,
+		pq.Array(client.RedirectURIs),
+		pq.Array(client.GrantTypes),
+		pq.Array(client.Scopes),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, stmt, args...).Scan(&client.ID, &client.CreatedAt, &client.Version)
+}
+
+const oauthClientColumns = `id, client_id, secret_hash, user_id, name, redirect_uris, grant_types, scopes, created_at, version`
+
+func scanOAuthClient(row rowScanner) (*OAuthClient, error) {
+	var client OAuthClient
+
+	err := row.Scan(
+		&client.ID,
+		&client.ClientID,
+		&client.SecretHash,
+		&client.UserID,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		pq.Array(&client.GrantTypes),
+		pq.Array(&client.Scopes),
+		&client.CreatedAt,
+		&client.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Confidential = client.SecretHash != nil
+
+	return &client, nil
+}
+
+func (m OAuthClientModel) GetByClientID(clientID string) (*OAuthClient, error) {
+	if !strings.HasPrefix(clientID, oauthClientIDPrefix) {
+		return nil, ErrRecoredNotFound
+	}
+
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients WHERE client_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	client, err := scanOAuthClient(m.DB.QueryRowContext(ctx, query, clientID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+func (m OAuthClientModel) GetAllForUser(userID int64) ([]*OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients WHERE user_id = $1 ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, client)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// DeleteForUser deletes a client of the user, every code and token issued to
+// it is deleted with it.
+func (m OAuthClientModel) DeleteForUser(id, userID int64) error {
+	if id < 1 {
+		return ErrRecoredNotFound
+	}
+
+	stmt := `
+		DELETE
+		FROM oauth_clients
+		WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecoredNotFound
+	}
+
+	return nil
+}
+
+// IsOAuthAccessToken reports whether token looks like an oauth access token
+// rather than a first-party authentication token.
+func IsOAuthAccessToken(token string) bool {
+	return strings.HasPrefix(token, oauthAccessTokenPrefix)
+}
+
+func ValidateOAuthAccessTokenPlaintext(v *validator.Validator, token string) {
+	v.Check(IsOAuthAccessToken(token), "token", "must be a valid access token")
+	v.Check(len(token) == len(oauthAccessTokenPrefix)+26, "token", "must be a valid access token")
+}
+
+// NewOAuthCode issues an authorization code bound to the client, the redirect
+// uri and the PKCE code challenge of the authorization request.
+func (m TokenModel) NewOAuthCode(userID int64, ttl time.Duration, clientID string, scopes []string, redirectURI, codeChallenge string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeOAuthCode)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ClientID = clientID
+	token.OAuthScopes = scopes
+	token.RedirectURI = redirectURI
+	token.CodeChallenge = codeChallenge
+
+	err = m.Insert(token)
+	return token, err
+}
+
+func (m TokenModel) NewOAuthAccess(userID int64, ttl time.Duration, clientID string, scopes []string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeOAuthAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	// the prefix lets the authenticate middleware tell oauth tokens apart
+	token.Plaintext = oauthAccessTokenPrefix + token.Plaintext
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	token.ClientID = clientID
+	token.OAuthScopes = scopes
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// ConsumeOAuthCode deletes an unexpired authorization code and returns it, so
+// a code can only ever be exchanged once.
+func (m TokenModel) ConsumeOAuthCode(codePlaintext string) (*Token, error) {
+	codeHash := sha256.Sum256([]byte(codePlaintext))
+
+	stmt := `
+		DELETE
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING id, user_id, expiry, created_at, client_id, oauth_scopes, redirect_uri, code_challenge
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token := Token{
+		Plaintext: codePlaintext,
+		Hash:      codeHash[:],
+		Scope:     ScopeOAuthCode,
+	}
+
+	err := m.DB.QueryRowContext(ctx, stmt, codeHash[:], ScopeOAuthCode, time.Now()).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Expiry,
+		&token.CreatedAt,
+		&token.ClientID,
+		pq.Array(&token.OAuthScopes),
+		&token.RedirectURI,
+		&token.CodeChallenge,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+func (m TokenModel) GetOAuthAccess(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT id, user_id, expiry, created_at, client_id, oauth_scopes
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+		Scope:     ScopeOAuthAccess,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeOAuthAccess, time.Now()).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Expiry,
+		&token.CreatedAt,
+		&token.ClientID,
+		pq.Array(&token.OAuthScopes),
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// DeleteOAuthForClient revokes an access token, a client can only revoke the
+// tokens issued to itself.
+func (m TokenModel) DeleteOAuthForClient(tokenPlaintext, clientID string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	stmt := `
+		DELETE
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND client_id = $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, tokenHash[:], ScopeOAuthAccess, clientID)
+	return err
+}
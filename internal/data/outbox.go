@@ -0,0 +1,350 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+var OutboxStatuses = []string{OutboxPending, OutboxSending, OutboxSent, OutboxDead}
+
+var ErrLeaseLost = errors.New("outbox lease lost")
+
+// OutboxEmail is an email waiting to be delivered by the outbox workers. Data
+// holds the template data and is never exposed, it contains tokens.
+type OutboxEmail struct {
+	ID            int64          `json:"id"`
+	Recipient     string         `json:"recipient"`
+	Template      string         `json:"template"`
+	Locale        string         `json:"locale"`
+	Data          map[string]any `json:"-"`
+	Status        string         `json:"status"`
+	Attempts      int            `json:"attempts"`
+	LastError     string         `json:"last_error,omitempty"`
+	NextAttemptAt time.Time      `json:"next_attempt_at"`
+	CreatedAt     time.Time      `json:"created_at"`
+	SentAt        *time.Time     `json:"sent_at,omitempty"`
+	Version       int            `json:"version"`
+}
+
+// Failed reports whether delivery of the email failed at least once and it
+// was not sent since.
+func (e *OutboxEmail) Failed() bool {
+	return e.Status == OutboxDead || (e.Status == OutboxPending && e.Attempts > 0)
+}
+
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx, so statements can be
+// shared between standalone calls and transactions.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func insertOutboxEmail(ctx context.Context, q querier, email *OutboxEmail) error {
+	stmt := `
+		INSERT INTO email_outbox (recipient, locale, template, data)
+		VALUES ($1, COALESCE(NULLIF($2, ''), 'en'), $3, $4)
+		RETURNING id, locale, status, next_attempt_at, created_at, version
+	`
+
+	if email.Data == nil {
+		email.Data = map[string]any{}
+	}
+
+	data, err := json.Marshal(email.Data)
+	if err != nil {
+		return err
+	}
+
+	args := []any{email.Recipient, email.Locale, email.Template, data}
+
+	return q.QueryRowContext(ctx, stmt, args...).Scan(&email.ID, &email.Locale, &email.Status, &email.NextAttemptAt, &email.CreatedAt, &email.Version)
+}
+
+// Enqueue stores an email for delivery by the outbox workers. It is rendered
+// in locale, or the closest locale the template exists in.
+func (m OutboxModel) Enqueue(recipient, locale, template string, data map[string]any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	email := &OutboxEmail{
+		Recipient: recipient,
+		Locale:    locale,
+		Template:  template,
+		Data:      data,
+	}
+
+	return insertOutboxEmail(ctx, m.DB, email)
+}
+
+const outboxColumns = `id, recipient, locale, template, data, status, attempts, last_error, next_attempt_at, created_at, sent_at, version`
+
+func scanOutboxEmail(row rowScanner) (*OutboxEmail, error) {
+	var email OutboxEmail
+	var data []byte
+
+	err := row.Scan(
+		&email.ID,
+		&email.Recipient,
+		&email.Locale,
+		&email.Template,
+		&data,
+		&email.Status,
+		&email.Attempts,
+		&email.LastError,
+		&email.NextAttemptAt,
+		&email.CreatedAt,
+		&email.SentAt,
+		&email.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// numbers are kept as json.Number so ids render as 42 and not 4.2e+01
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	err = dec.Decode(&email.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &email, nil
+}
+
+// Claim locks up to limit emails that are due for the caller. Rows claimed by
+// other workers are skipped, and rows whose lease ran out, because the worker
+// holding them died, are claimed again. Every claim bumps the version, which
+// MarkSent and MarkFailed use to detect a lease that was taken over.
+func (m OutboxModel) Claim(limit int, lease time.Duration) ([]*OutboxEmail, error) {
+	stmt := `
+		UPDATE email_outbox
+		SET status = 'sending', attempts = attempts + 1, locked_until = NOW() + make_interval(secs => $2), version = version + 1
+		WHERE id IN (
+			SELECT id
+			FROM email_outbox
+			WHERE (status = 'pending' AND next_attempt_at <= NOW())
+			OR (status = 'sending' AND locked_until < NOW())
+			ORDER BY next_attempt_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + outboxColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	emails := []*OutboxEmail{}
+	for rows.Next() {
+		email, err := scanOutboxEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return emails, nil
+}
+
+// MarkSent records a successful delivery and drops the template data, which
+// is no longer needed and may contain tokens.
+func (m OutboxModel) MarkSent(email *OutboxEmail) error {
+	stmt := `
+		UPDATE email_outbox
+		SET status = 'sent', sent_at = NOW(), locked_until = NULL, last_error = '', data = '{}', version = version + 1
+		WHERE id = $1 AND status = 'sending' AND version = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, email.ID, email.Version)
+	if err != nil {
+		return err
+	}
+
+	return checkLease(result)
+}
+
+// MarkFailed schedules another attempt at nextAttempt, or moves the email to
+// the dead-letter state when dead is true.
+func (m OutboxModel) MarkFailed(email *OutboxEmail, sendErr error, nextAttempt time.Time, dead bool) error {
+	stmt := `
+		UPDATE email_outbox
+		SET status = $2, last_error = $3, next_attempt_at = $4, locked_until = NULL, version = version + 1
+		WHERE id = $1 AND status = 'sending' AND version = $5
+	`
+
+	status := OutboxPending
+	if dead {
+		status = OutboxDead
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, email.ID, status, sendErr.Error(), nextAttempt, email.Version)
+	if err != nil {
+		return err
+	}
+
+	return checkLease(result)
+}
+
+// checkLease returns ErrLeaseLost when an update of a claimed email changed
+// nothing, because its lease ran out and another worker claimed it again.
+func checkLease(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+func (m OutboxModel) Get(id int64) (*OutboxEmail, error) {
+	if id < 1 {
+		return nil, ErrRecoredNotFound
+	}
+
+	query := `SELECT ` + outboxColumns + ` FROM email_outbox WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	email, err := scanOutboxEmail(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return email, nil
+}
+
+// GetAll returns a page of outbox emails, optionally only the ones with the
+// given status.
+func (m OutboxModel) GetAll(status string, filters Filters) ([]*OutboxEmail, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), %s
+		FROM email_outbox
+		WHERE (status = $1 OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT %d
+		OFFSET (%d - 1) * %d
+		`,
+		outboxColumns,
+		filters.sortColumn(),
+		filters.sortDirection(),
+		filters.PageSize,
+		filters.Page,
+		filters.PageSize,
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	emails := []*OutboxEmail{}
+
+	for rows.Next() {
+		var data []byte
+		var email OutboxEmail
+
+		err := rows.Scan(
+			&totalRecords,
+			&email.ID,
+			&email.Recipient,
+			&email.Locale,
+			&email.Template,
+			&data,
+			&email.Status,
+			&email.Attempts,
+			&email.LastError,
+			&email.NextAttemptAt,
+			&email.CreatedAt,
+			&email.SentAt,
+			&email.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		emails = append(emails, &email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	meta := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return emails, meta, nil
+}
+
+// Requeue makes a failed email due immediately with a fresh attempts budget.
+func (m OutboxModel) Requeue(email *OutboxEmail) error {
+	stmt := `
+		UPDATE email_outbox
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW(), version = version + 1
+		WHERE id = $1 AND version = $2
+		RETURNING status, attempts, next_attempt_at, version
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, email.ID, email.Version).Scan(&email.Status, &email.Attempts, &email.NextAttemptAt, &email.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
@@ -5,9 +5,11 @@ import (
 	"database/sql"
 	"errors"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
 )
 
 type PermissionModel struct {
@@ -16,18 +18,113 @@ type PermissionModel struct {
 
 type Permissions []string
 
+// PermissionWildcard grants every permission when it is a whole code ("*"),
+// or every code below a prefix when it is the last segment ("movies:*").
+const PermissionWildcard = "*"
+
+// permissionImplications lists the codes that are granted implicitly by
+// holding another code. Implications are followed transitively.
+var permissionImplications = map[string][]string{
+	"movies:write":     {"movies:read", "movies:write:own"},
+	"movies:write:own": {"movies:read"},
+}
+
+// Include reports whether code is granted by p, either exactly, through a
+// wildcard or through an implication.
 func (p Permissions) Include(code string) bool {
-	v := slices.Index(p, code)
-	return !(v == -1)
+	for _, granted := range p {
+		if grants(granted, code, 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p Permissions) IncludeAny(codes ...string) bool {
+	return slices.ContainsFunc(codes, p.Include)
+}
+
+func (p Permissions) IncludeAll(codes ...string) bool {
+	for _, code := range codes {
+		if !p.Include(code) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ValidatePermissionCodes checks that every code is one of the known codes.
+// The match is exact, Include would accept any string once "*" is known.
+func ValidatePermissionCodes(v *validator.Validator, key string, known Permissions, codes []string) {
+	for _, code := range codes {
+		v.Check(slices.Contains(known, code), key, "must only contain known permission codes")
+	}
+}
+
+func grants(granted, code string, depth int) bool {
+	if matchPermission(granted, code) {
+		return true
+	}
+
+	// guards against cycles in the implications table
+	if depth > len(permissionImplications) {
+		return false
+	}
+
+	for _, implied := range permissionImplications[granted] {
+		if grants(implied, code, depth+1) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchPermission(pattern, code string) bool {
+	if pattern == code || pattern == PermissionWildcard {
+		return true
+	}
+
+	patternSegments := strings.Split(pattern, ":")
+	codeSegments := strings.Split(code, ":")
+
+	for i, segment := range patternSegments {
+		if i >= len(codeSegments) {
+			return false
+		}
+
+		if segment == PermissionWildcard {
+			// a trailing wildcard matches every remaining segment
+			if i == len(patternSegments)-1 {
+				return true
+			}
+			continue
+		}
+
+		if segment != codeSegments[i] {
+			return false
+		}
+	}
+
+	return len(patternSegments) == len(codeSegments)
 }
 
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	// effective permissions are the union of direct grants and the
+	// permissions of every role assigned to the user
 	query := `
 		SELECT permissions.code 
 		FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -43,6 +140,8 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		}
 	}
 
+	defer rows.Close()
+
 	var permissions Permissions
 	for rows.Next() {
 		var permission string
@@ -66,6 +165,7 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	stmt := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -76,3 +176,111 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 
 	return err
 }
+
+func (m PermissionModel) GetAllCodes() (Permissions, error) {
+	query := `
+		SELECT DISTINCT code
+		FROM permissions
+		ORDER BY code
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// RemoveForUser revokes directly granted permissions, it returns
+// ErrRecoredNotFound when the user held none of them.
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	stmt := `
+		DELETE
+		FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = ANY($2)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecoredNotFound
+	}
+
+	return nil
+}
+
+// GetDirectForUser returns only the permissions granted to the user directly,
+// without the ones inherited from roles.
+func (m PermissionModel) GetDirectForUser(userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1
+		ORDER BY permissions.code
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+func TestPermissionsInclude(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions Permissions
+		code        string
+		want        bool
+	}{
+		{"exact match", Permissions{"movies:read"}, "movies:read", true},
+		{"no permissions", nil, "movies:read", false},
+		{"different code", Permissions{"movies:read"}, "movies:write", false},
+		{"global wildcard", Permissions{"*"}, "users:admin", true},
+		{"resource wildcard", Permissions{"movies:*"}, "movies:write", true},
+		{"resource wildcard nested code", Permissions{"movies:*"}, "movies:write:own", true},
+		{"resource wildcard other resource", Permissions{"movies:*"}, "users:admin", false},
+		{"resource wildcard bare resource", Permissions{"movies:*"}, "movies", false},
+		{"middle wildcard", Permissions{"movies:*:own"}, "movies:write:own", true},
+		{"middle wildcard other suffix", Permissions{"movies:*:own"}, "movies:write:all", false},
+		{"prefix is not a match", Permissions{"movies"}, "movies:read", false},
+		{"write implies read", Permissions{"movies:write"}, "movies:read", true},
+		{"read does not imply write", Permissions{"movies:read"}, "movies:write", false},
+		{"write implies write own", Permissions{"movies:write"}, "movies:write:own", true},
+		{"write own implies read", Permissions{"movies:write:own"}, "movies:read", true},
+		{"write own does not imply write", Permissions{"movies:write:own"}, "movies:write", false},
+		{"one of many", Permissions{"users:admin", "movies:read"}, "movies:read", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.permissions.Include(tt.code)
+			if got != tt.want {
+				t.Errorf("%v.Include(%q) = %t, want %t", tt.permissions, tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionsIncludeAnyAll(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions Permissions
+		codes       []string
+		wantAny     bool
+		wantAll     bool
+	}{
+		{"all granted", Permissions{"movies:write", "users:admin"}, []string{"movies:read", "users:admin"}, true, true},
+		{"some granted", Permissions{"movies:read"}, []string{"movies:read", "users:admin"}, true, false},
+		{"none granted", Permissions{"movies:read"}, []string{"roles:admin", "users:admin"}, false, false},
+		{"wildcard grants all", Permissions{"*"}, []string{"roles:admin", "users:admin"}, true, true},
+		{"no codes", Permissions{"movies:read"}, nil, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.permissions.IncludeAny(tt.codes...); got != tt.wantAny {
+				t.Errorf("IncludeAny(%v) = %t, want %t", tt.codes, got, tt.wantAny)
+			}
+
+			if got := tt.permissions.IncludeAll(tt.codes...); got != tt.wantAll {
+				t.Errorf("IncludeAll(%v) = %t, want %t", tt.codes, got, tt.wantAll)
+			}
+		})
+	}
+}
+
+func TestValidatePermissionCodes(t *testing.T) {
+	known := Permissions{"*", "movies:read", "movies:write", "users:admin"}
+
+	tests := []struct {
+		name  string
+		codes []string
+		valid bool
+	}{
+		{"known codes", []string{"movies:read", "users:admin"}, true},
+		{"global wildcard itself", []string{"*"}, true},
+		{"unknown code", []string{"movies:read", "garbage"}, false},
+		{"code matched by a wildcard only", []string{"movies:delete"}, false},
+		{"unknown wildcard", []string{"movies:*"}, false},
+		{"no codes", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidatePermissionCodes(v, "codes", known, tt.codes)
+
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %v, want %v (errors %v)", v.Valid(), tt.valid, v.Errors)
+			}
+		})
+	}
+}
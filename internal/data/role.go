@@ -0,0 +1,336 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+var (
+	ErrDuplicateRoleName = errors.New("duplicate role name")
+	ErrBuiltInRole       = errors.New("built-in role")
+)
+
+type Role struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	BuiltIn     bool        `json:"built_in"`
+	Permissions Permissions `json:"permissions"`
+	Version     int         `json:"version"`
+}
+
+type RoleModel struct {
+	DB *sql.DB
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
+
+const roleColumns = `
+	roles.id, roles.created_at, roles.name, roles.description, roles.built_in, roles.version,
+	COALESCE(ARRAY(
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		WHERE roles_permissions.role_id = roles.id
+		ORDER BY permissions.code
+	), '{}')
+`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRole(row rowScanner) (*Role, error) {
+	var role Role
+
+	err := row.Scan(
+		&role.ID,
+		&role.CreatedAt,
+		&role.Name,
+		&role.Description,
+		&role.BuiltIn,
+		&role.Version,
+		pq.Array(&role.Permissions),
+	)
+
+	return &role, err
+}
+
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+		INSERT INTO roles (name, description)
+		VALUES ($1, $2)
+		RETURNING id, created_at, built_in, version
+	`
+
+	err = tx.QueryRowContext(ctx, stmt, role.Name, role.Description).Scan(&role.ID, &role.CreatedAt, &role.BuiltIn, &role.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		default:
+			return err
+		}
+	}
+
+	err = setRolePermissions(ctx, tx, role.ID, role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecoredNotFound
+	}
+
+	query := `SELECT ` + roleColumns + ` FROM roles WHERE roles.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	role, err := scanRole(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return role, nil
+}
+
+func (m RoleModel) GetByName(name string) (*Role, error) {
+	query := `SELECT ` + roleColumns + ` FROM roles WHERE roles.name = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	role, err := scanRole(m.DB.QueryRowContext(ctx, query, name))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return role, nil
+}
+
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `SELECT ` + roleColumns + ` FROM roles ORDER BY roles.id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (m RoleModel) GetAllForUser(userID int64) ([]*Role, error) {
+	query := `
+		SELECT ` + roleColumns + `
+		FROM roles
+		INNER JOIN users_roles ON users_roles.role_id = roles.id
+		WHERE users_roles.user_id = $1
+		ORDER BY roles.id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Update changes the name, description and permission set of a role. Built-in
+// roles keep their name so the default role configuration can rely on it.
+func (m RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+		UPDATE roles
+		SET name = CASE WHEN built_in THEN name ELSE $1 END, description = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING name, version
+	`
+
+	err = tx.QueryRowContext(ctx, stmt, role.Name, role.Description, role.ID, role.Version).Scan(&role.Name, &role.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM roles_permissions WHERE role_id = $1`, role.ID)
+	if err != nil {
+		return err
+	}
+
+	err = setRolePermissions(ctx, tx, role.ID, role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m RoleModel) Delete(id int64) error {
+	stmt := `
+		DELETE
+		FROM roles
+		WHERE id = $1
+		RETURNING built_in
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var builtIn bool
+	err = tx.QueryRowContext(ctx, stmt, id).Scan(&builtIn)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecoredNotFound
+		default:
+			return err
+		}
+	}
+
+	if builtIn {
+		return ErrBuiltInRole
+	}
+
+	return tx.Commit()
+}
+
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return addRolesForUser(ctx, m.DB, userID, names...)
+}
+
+func addRolesForUser(ctx context.Context, q querier, userID int64, names ...string) error {
+	stmt := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING
+	`
+
+	_, err := q.ExecContext(ctx, stmt, userID, pq.Array(names))
+	return err
+}
+
+func (m RoleModel) RemoveForUser(userID int64, names ...string) error {
+	stmt := `
+		DELETE
+		FROM users_roles
+		USING roles
+		WHERE users_roles.role_id = roles.id
+		AND users_roles.user_id = $1
+		AND roles.name = ANY($2)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, userID, pq.Array(names))
+	return err
+}
+
+func setRolePermissions(ctx context.Context, tx *sql.Tx, roleID int64, codes []string) error {
+	stmt := `
+		INSERT INTO roles_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
+	`
+
+	_, err := tx.ExecContext(ctx, stmt, roleID, pq.Array(codes))
+	return err
+}
@@ -6,16 +6,23 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/mahmoud-shabban/greenlight/internal/validator"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeRefresh        = "refresh"
+	ScopeMFA            = "mfa"
+	ScopePasswordReset  = "password-reset"
+	ScopeMagicLink      = "magic-link"
+	ScopeOAuthCode      = "oauth-code"
+	ScopeOAuthAccess    = "oauth-access"
 )
 
 type TokenModel struct {
@@ -23,11 +30,35 @@ type TokenModel struct {
 }
 
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Plaintext  string     `json:"token"`
+	Hash       []byte     `json:"-"`
+	UserID     int64      `json:"-"`
+	Expiry     time.Time  `json:"expiry"`
+	Scope      string     `json:"-"`
+	ID         int64      `json:"-"`
+	CreatedAt  time.Time  `json:"-"`
+	LastUsedAt time.Time  `json:"-"`
+	IP         string     `json:"-"`
+	UserAgent  string     `json:"-"`
+	Family     string     `json:"-"`
+	UsedAt     *time.Time `json:"-"`
+
+	// set on oauth authorization codes and access tokens only
+	ClientID      string   `json:"-"`
+	OAuthScopes   []string `json:"-"`
+	RedirectURI   string   `json:"-"`
+	CodeChallenge string   `json:"-"`
+}
+
+// Session is the user facing view of an authentication token, it never
+// exposes the token plaintext or hash.
+type Session struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Expiry     time.Time `json:"expiry"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -60,8 +91,7 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 }
 
 func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string, tracer trace.Tracer) (*Token, error) {
-	// _, span := tracer.Start(ctx, "new auth token")
-	_, span := otel.Tracer("mainTracer").Start(ctx, "new auth token 2")
+	_, span := tracer.Start(ctx, "new auth token")
 	defer span.End()
 
 	span.AddEvent("generating token")
@@ -76,18 +106,176 @@ func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, sc
 	return token, err
 }
 
+// NewFamily returns a random identifier shared by every authentication and
+// refresh token issued from the same login, so a whole chain can be revoked.
+func (m TokenModel) NewFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+func (m TokenModel) NewSession(ctx context.Context, userID int64, ttl time.Duration, family, ip, userAgent string, tracer trace.Tracer) (*Token, error) {
+	return m.newSessionToken(ctx, userID, ttl, ScopeAuthentication, family, ip, userAgent, tracer)
+}
+
+func (m TokenModel) NewRefresh(ctx context.Context, userID int64, ttl time.Duration, family, ip, userAgent string, tracer trace.Tracer) (*Token, error) {
+	return m.newSessionToken(ctx, userID, ttl, ScopeRefresh, family, ip, userAgent, tracer)
+}
+
+func (m TokenModel) newSessionToken(ctx context.Context, userID int64, ttl time.Duration, scope, family, ip, userAgent string, tracer trace.Tracer) (*Token, error) {
+	_, span := tracer.Start(ctx, "new "+scope+" token")
+	defer span.End()
+
+	span.AddEvent("generating token")
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Family = family
+	token.IP = ip
+	token.UserAgent = userAgent
+
+	span.AddEvent("inser token into database")
+	err = m.Insert(token)
+	return token, err
+}
+
 func (m TokenModel) Insert(token *Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertToken(ctx, m.DB, token)
+}
+
+func insertToken(ctx context.Context, q querier, token *Token) error {
 	stmt := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES($1, $2, $3, $4)
+		INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, family, client_id, oauth_scopes, redirect_uri, code_challenge)
+		VALUES($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, $10, $11)
+		RETURNING id, created_at, last_used_at
+	`
+
+	oauthScopes := token.OAuthScopes
+	if oauthScopes == nil {
+		oauthScopes = []string{}
+	}
+
+	args := []any{
+		token.Hash,
+		token.UserID,
+		token.Expiry,
+		token.Scope,
+		token.IP,
+		token.UserAgent,
+		token.Family,
+		token.ClientID,
+		pq.Array(oauthScopes),
+		token.RedirectURI,
+		token.CodeChallenge,
+	}
+
+	return q.QueryRowContext(ctx, stmt, args...).Scan(&token.ID, &token.CreatedAt, &token.LastUsedAt)
+}
+
+func (m TokenModel) GetSessionsForUser(userID int64) ([]*Session, error) {
+	query := `
+		SELECT id, created_at, last_used_at, expiry, ip, user_agent
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $3
+		ORDER BY last_used_at DESC, id DESC
 	`
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, stmt, args...)
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (m TokenModel) DeleteSessionForUser(id, userID int64) error {
+	// deleting a session also revokes the refresh tokens of its family
+	stmt := `
+		DELETE
+		FROM tokens
+		WHERE user_id = $2
+		AND (
+			(id = $1 AND scope = $3)
+			OR family IN (
+				SELECT family FROM tokens
+				WHERE id = $1 AND user_id = $2 AND scope = $3 AND family <> ''
+			)
+		)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, id, userID, ScopeAuthentication)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecoredNotFound
+	}
+
+	return nil
+}
+
+// TouchSession records the last time an authentication token was used. Callers
+// are expected to throttle it, it always issues a write.
+func (m TokenModel) TouchSession(tokenPlaintext string, lastUsed time.Time) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
+	stmt := `
+		UPDATE tokens
+		SET last_used_at = $1
+		WHERE hash = $2 AND scope = $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, lastUsed, tokenHash[:], ScopeAuthentication)
 	return err
 }
 
@@ -104,3 +292,143 @@ func (m TokenModel) DeleteAllForUser(userID int64, scope string) error {
 	_, err := m.DB.ExecContext(ctx, stmt, args...)
 	return err
 }
+
+// Consume deletes an unexpired token and returns the id of its owner, so
+// that concurrent requests can not use the same single-use token twice.
+func (m TokenModel) Consume(scope, tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	stmt := `
+		DELETE
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int64
+
+	args := []any{tokenHash[:], scope, time.Now()}
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecoredNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
+
+// CountCreatedSince returns how many tokens of scope were issued to the user
+// after since.
+func (m TokenModel) CountCreatedSince(userID int64, scope string, since time.Time) (int, error) {
+	stmt := `
+		SELECT COUNT(*)
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND created_at > $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+
+	err := m.DB.QueryRowContext(ctx, stmt, userID, scope, since).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// GetRefresh looks up an unexpired refresh token, including tokens that were
+// already used so that replays can be detected by the caller.
+func (m TokenModel) GetRefresh(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT id, user_id, expiry, created_at, family, used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+		Scope:     ScopeRefresh,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh, time.Now()).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Expiry,
+		&token.CreatedAt,
+		&token.Family,
+		&token.UsedAt,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// ConsumeRefresh marks a refresh token as used. It returns ErrRecoredNotFound
+// when the token was already used, which happens when two requests race with
+// the same refresh token.
+func (m TokenModel) ConsumeRefresh(token *Token) error {
+	stmt := `
+		UPDATE tokens
+		SET used_at = $1
+		WHERE hash = $2 AND scope = $3 AND used_at IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	result, err := m.DB.ExecContext(ctx, stmt, now, token.Hash, ScopeRefresh)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecoredNotFound
+	}
+
+	token.UsedAt = &now
+	return nil
+}
+
+func (m TokenModel) DeleteFamily(family string, scopes ...string) error {
+	stmt := `
+		DELETE
+		FROM tokens
+		WHERE family = $1 AND family <> '' AND ($2::text[] IS NULL OR scope = ANY($2))
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, family, pq.Array(scopes))
+	return err
+}
@@ -0,0 +1,278 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+const recoveryCodesCount = 10
+
+type TOTP struct {
+	UserID       int64
+	Secret       string
+	CreatedAt    time.Time
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+}
+
+func (t *TOTP) Confirmed() bool {
+	return t.ConfirmedAt != nil
+}
+
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+func ValidateRecoveryCode(v *validator.Validator, code string) {
+	v.Check(code != "", "recovery_code", "must be provided")
+	v.Check(len(normalizeRecoveryCode(code)) == 10, "recovery_code", "must be 10 characters long")
+}
+
+// Get returns the enrolment of the user, confirmed or not.
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, secret, created_at, confirmed_at, last_used_step
+		FROM users_totp
+		WHERE user_id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t TOTP
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&t.UserID,
+		&t.Secret,
+		&t.CreatedAt,
+		&t.ConfirmedAt,
+		&t.LastUsedStep,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// Enrol stores a new pending secret for the user, replacing any previous
+// unconfirmed enrolment.
+func (m TOTPModel) Enrol(userID int64, secret string) error {
+	stmt := `
+		INSERT INTO users_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+		WHERE users_totp.confirmed_at IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+func (m TOTPModel) Confirm(userID int64, step int64) error {
+	stmt := `
+		UPDATE users_totp
+		SET confirmed_at = NOW(), last_used_step = $2
+		WHERE user_id = $1 AND confirmed_at IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// UseStep records step as used. It returns ErrEditConflict when the step, or
+// a later one, was already used so a code can only be used once.
+func (m TOTPModel) UseStep(userID int64, step int64) error {
+	stmt := `
+		UPDATE users_totp
+		SET last_used_step = $2
+		WHERE user_id = $1 AND last_used_step < $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Enabled reports whether the user has a confirmed totp enrolment.
+func (m TOTPModel) Enabled(userID int64) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM users_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL
+		)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var enabled bool
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// NewRecoveryCodes replaces the recovery codes of the user and returns the new
+// plaintext codes, only their hashes are stored.
+func (m TOTPModel) NewRecoveryCodes(userID int64) ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 6)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO totp_recovery_codes (hash, user_id) VALUES ($1, $2)`, hash[:], userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// UseRecoveryCode consumes a recovery code. It returns ErrRecoredNotFound when
+// the code does not exist or was already used.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) error {
+	hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+
+	stmt := `
+		UPDATE totp_recovery_codes
+		SET used_at = NOW()
+		WHERE hash = $1 AND user_id = $2 AND used_at IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, hash[:], userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecoredNotFound
+	}
+
+	return nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
@@ -5,10 +5,12 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/mahmoud-shabban/greenlight/internal/passhash"
 	"github.com/mahmoud-shabban/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var AnonymousUser = &User{}
@@ -20,7 +22,13 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
+	Locked    bool      `json:"locked"`
+	Language  string    `json:"language"`
 	Version   int       `json:"version"`
+
+	FailedLoginAttempts int        `json:"-"`
+	LastFailedLoginAt   *time.Time `json:"-"`
+	LockedUntil         *time.Time `json:"-"`
 }
 
 var (
@@ -36,35 +44,55 @@ type password struct {
 	hash      []byte
 }
 
+// passwordHasher is used by every password. It is replaced at startup with
+// the configured one through SetPasswordHasher.
+var passwordHasher = passhash.New(passhash.DefaultArgon2id(), passhash.Bcrypt{Cost: 12})
+
+func SetPasswordHasher(h *passhash.Hasher) {
+	passwordHasher = h
+}
+
 func (p *password) Set(plainText string) error {
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(plainText), 12)
+	hash, err := passwordHasher.Hash(plainText)
 
 	if err != nil {
 		return err
 	}
 
 	p.plainText = &plainText
-	p.hash = hash
+	p.hash = []byte(hash)
 
 	return nil
 }
 
 func (p *password) Matches(plainText string) (bool, error) {
+	return passwordHasher.Verify(plainText, string(p.hash))
+}
 
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plainText))
+// NeedsRehash reports whether the stored hash uses an old algorithm or out of
+// date parameters and should be replaced on the next successful login.
+func (p *password) NeedsRehash() bool {
+	return passwordHasher.NeedsRehash(string(p.hash))
+}
 
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
+var (
+	dummyPasswordOnce sync.Once
+	dummyPassword     password
+)
 
-	return true, nil
+// SimulatePasswordMatch spends the same time as a real password comparison, it
+// is used when the user does not exist so response times do not reveal which
+// email addresses are registered.
+func SimulatePasswordMatch(plainText string) {
+	dummyPasswordOnce.Do(func() {
+		err := dummyPassword.Set("greenlight-dummy-password")
+		if err != nil {
+			panic(err)
+		}
+	})
 
+	dummyPassword.Matches(plainText)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -72,10 +100,10 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
+// ValidatePasswordPlainText only checks that a password was provided, its
+// length and strength are the business of the configured password policy.
 func ValidatePasswordPlainText(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) <= 72, "password", "must not be more than 75 bytes long")
-	v.Check(len(password) >= 8, "password", "must not be less than 8 bytes long")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -95,19 +123,23 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 func (u *UserModel) Insert(user *User) error {
-	stmt := `
-		INSERT INTO users(name,email, password_hash, activated)
-		VALUES($1, $2, $3, $4)
-		RETURNING id, created_at, version
-	`
-
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 
 	defer cancel()
 
-	err := u.DB.QueryRowContext(ctx, stmt, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	return insertUser(ctx, u.DB, user)
+}
+
+func insertUser(ctx context.Context, q querier, user *User) error {
+	stmt := `
+		INSERT INTO users(name,email, password_hash, activated, language)
+		VALUES($1, $2, $3, $4, COALESCE(NULLIF($5, ''), 'en'))
+		RETURNING id, created_at, language, version
+	`
+
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.Language}
+
+	err := q.QueryRowContext(ctx, stmt, args...).Scan(&user.ID, &user.CreatedAt, &user.Language, &user.Version)
 
 	if err != nil {
 		switch {
@@ -121,10 +153,69 @@ func (u *UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Register inserts a new user together with its role, an activation token
+// and the welcome email in a single transaction, so the email is queued if
+// and only if the user exists.
+func (u *UserModel) Register(user *User, role string, activationTTL time.Duration, template string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// a no-op once the transaction was committed
+	defer tx.Rollback()
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addRolesForUser(ctx, tx, user.ID, role)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(user.ID, activationTTL, ScopeActivation)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	email := &OutboxEmail{
+		Recipient: user.Email,
+		Locale:    user.Language,
+		Template:  template,
+		Data: map[string]any{
+			"userID":          user.ID,
+			"activationToken": token.Plaintext,
+		},
+	}
+
+	err = insertOutboxEmail(ctx, tx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
 func (u *UserModel) GetByEmail(email string) (*User, error) {
 
 	stmt := `
-		SELECT id, created_at, name, email, password_hash, activated, version 
+		SELECT id, created_at, name, email, password_hash, activated, locked, version,
+			failed_login_attempts, last_failed_login_at, locked_until, language
 		FROM USERS 
 		WHERE email = $1
 	`
@@ -141,7 +232,56 @@ func (u *UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locked,
+		&user.Version,
+		&user.FailedLoginAttempts,
+		&user.LastFailedLoginAt,
+		&user.LockedUntil,
+		&user.Language,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecoredNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func (u *UserModel) Get(id int64) (*User, error) {
+
+	if id < 1 {
+		return nil, ErrRecoredNotFound
+	}
+
+	stmt := `
+		SELECT id, created_at, name, email, password_hash, activated, locked, version,
+			failed_login_attempts, last_failed_login_at, locked_until, language
+		FROM users
+		WHERE id = $1
+	`
+
+	user := User{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := u.DB.QueryRowContext(ctx, stmt, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locked,
 		&user.Version,
+		&user.FailedLoginAttempts,
+		&user.LastFailedLoginAt,
+		&user.LockedUntil,
+		&user.Language,
 	)
 
 	if err != nil {
@@ -159,12 +299,12 @@ func (u *UserModel) Update(user *User) error {
 
 	stmt := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, password_hash = $3, activated = $4, locked = $5, language = $6, version = version + 1
+		WHERE id = $7 AND version = $8
 		RETURNING version
 	`
 
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.ID, user.Version}
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.Locked, user.Language, user.ID, user.Version}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 
 	defer cancel()
@@ -177,16 +317,140 @@ func (u *UserModel) Update(user *User) error {
 			return ErrDublicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
+		default:
+			return err
 		}
 	}
 	return nil
 }
 
+// UpdatePasswordHash stores a new hash of the current password. Unlike Update
+// it does not bump the record version, it is used to upgrade hashes on login.
+func (u *UserModel) UpdatePasswordHash(user *User) error {
+	stmt := `
+		UPDATE users
+		SET password_hash = $1
+		WHERE id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := u.DB.ExecContext(ctx, stmt, user.Password.hash, user.ID)
+	return err
+}
+
+// RecordLoginFailure increments the failed login counter of the user and locks
+// the account for lockout once maxAttempts is reached. It does not bump the
+// record version so it never causes edit conflicts.
+func (u *UserModel) RecordLoginFailure(user *User, maxAttempts int, lockout time.Duration) error {
+	stmt := `
+		UPDATE users
+		SET failed_login_attempts = failed_login_attempts + 1,
+			last_failed_login_at = NOW(),
+			locked_until = CASE
+				WHEN failed_login_attempts + 1 >= $2 THEN NOW() + make_interval(secs => $3)
+				ELSE locked_until
+			END
+		WHERE id = $1
+		RETURNING failed_login_attempts, last_failed_login_at, locked_until
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{user.ID, maxAttempts, lockout.Seconds()}
+	return u.DB.QueryRowContext(ctx, stmt, args...).Scan(&user.FailedLoginAttempts, &user.LastFailedLoginAt, &user.LockedUntil)
+}
+
+func (u *UserModel) ResetLoginFailures(user *User) error {
+	stmt := `
+		UPDATE users
+		SET failed_login_attempts = 0, last_failed_login_at = NULL, locked_until = NULL
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := u.DB.ExecContext(ctx, stmt, user.ID)
+	if err != nil {
+		return err
+	}
+
+	user.FailedLoginAttempts = 0
+	user.LastFailedLoginAt = nil
+	user.LockedUntil = nil
+
+	return nil
+}
+
+// GetAll returns a page of users whose name or email contains search.
+func (u *UserModel) GetAll(search string, filters Filters) ([]*User, Metadata, error) {
+	stmt := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, created_at, name, email, activated, locked, language, version
+		FROM users
+		WHERE (name ILIKE '%%' || $1 || '%%' OR email ILIKE '%%' || $1 || '%%' OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT %d
+		OFFSET (%d - 1) * %d
+		`,
+		filters.sortColumn(),
+		filters.sortDirection(),
+		filters.PageSize,
+		filters.Page,
+		filters.PageSize,
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := u.DB.QueryContext(ctx, stmt, search)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Locked,
+			&user.Language,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	meta := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, meta, nil
+}
+
 func (m *UserModel) GetForToken(scope string, token string) (*User, error) {
 
 	tokenHash := sha256.Sum256([]byte(token))
 	stmt := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version 
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locked, users.version,
+			users.failed_login_attempts, users.last_failed_login_at, users.locked_until, users.language
 		FROM users
 		INNER JOIN tokens 
 		ON users.id = tokens.user_id
@@ -208,7 +472,12 @@ func (m *UserModel) GetForToken(scope string, token string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locked,
 		&user.Version,
+		&user.FailedLoginAttempts,
+		&user.LastFailedLoginAt,
+		&user.LockedUntil,
+		&user.Language,
 	)
 
 	if err != nil {
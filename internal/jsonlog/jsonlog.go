@@ -1,17 +1,27 @@
 package jsonlog
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"log/slog"
+	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Level int8
 
 const (
-	LevelInfo Level = iota
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
 	LevelError
 	LevelFatal
 	LevelOff
@@ -19,62 +29,256 @@ const (
 
 func (l Level) String() string {
 	switch l {
-	case 0:
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
 		return "INFO"
-	case 1:
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
 		return "ERROR"
-	case 2:
+	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// ParseLevel parses the name of a level, case insensitively.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+
+	return LevelOff, fmt.Errorf("unknown log level %q", s)
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+
+	*l = level
+	return nil
+}
+
+// Correlation ties a log entry to the request it was written for.
+type Correlation struct {
+	RequestID string
+	UserID    int64
+}
+
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	out         io.Writer
+	minLevel    atomic.Int32
+	stackTraces atomic.Bool
+	correlation func(ctx context.Context) Correlation
+	mu          sync.Mutex
 }
 
 func New(out io.Writer, minlevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minlevel,
-	}
+	l := &Logger{out: out}
+	l.minLevel.Store(int32(minlevel))
+
+	return l
+}
+
+// Level returns the minimum level of entries that are written.
+func (l *Logger) Level() Level {
+	return Level(l.minLevel.Load())
+}
+
+// SetLevel changes the minimum level at runtime.
+func (l *Logger) SetLevel(level Level) {
+	l.minLevel.Store(int32(level))
+}
+
+// SetStackTraces controls whether ERROR and FATAL entries include the stack
+// of the logging goroutine.
+func (l *Logger) SetStackTraces(enabled bool) {
+	l.stackTraces.Store(enabled)
+}
+
+// SetCorrelation sets the function that finds the request id and user id in
+// the context passed to the Context methods. It must be called before the
+// logger is used.
+func (l *Logger) SetCorrelation(fn func(ctx context.Context) Correlation) {
+	l.correlation = fn
+}
+
+// Enabled reports whether entries of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level() && level < LevelOff
+}
+
+func (l *Logger) PrintDebug(message string, properties map[string]string) {
+	l.print(LevelDebug, message, properties)
 }
 
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
 	l.print(LevelInfo, message, properties)
 }
 
+func (l *Logger) PrintWarn(message string, properties map[string]string) {
+	l.print(LevelWarn, message, properties)
+}
+
 func (l *Logger) PrintError(err error, properties map[string]string) {
 	l.print(LevelError, err.Error(), properties)
 }
 
+// PrintFatal writes the entry and terminates the program.
 func (l *Logger) PrintFatal(err error, properties map[string]string) {
 	l.print(LevelFatal, err.Error(), properties)
+	os.Exit(1)
+}
+
+// The Context variants add the request id, user id and the OpenTelemetry
+// trace and span ids found in ctx to the entry.
+func (l *Logger) PrintDebugContext(ctx context.Context, message string, properties map[string]string) {
+	l.printContext(ctx, LevelDebug, message, properties)
+}
+
+func (l *Logger) PrintInfoContext(ctx context.Context, message string, properties map[string]string) {
+	l.printContext(ctx, LevelInfo, message, properties)
+}
+
+func (l *Logger) PrintWarnContext(ctx context.Context, message string, properties map[string]string) {
+	l.printContext(ctx, LevelWarn, message, properties)
+}
+
+func (l *Logger) PrintErrorContext(ctx context.Context, err error, properties map[string]string) {
+	l.printContext(ctx, LevelError, err.Error(), properties)
+}
+
+// PrintAuditContext writes an INFO entry whatever the minimum level is, so
+// audit entries can not be silenced by raising the level at runtime.
+func (l *Logger) PrintAuditContext(ctx context.Context, message string, properties map[string]string) {
+	l.write(ctx, LevelInfo, time.Now(), message, typedProperties(properties))
+}
+
+// Debug, Info, Warn and Error take typed attributes as alternating keys and
+// values or slog.Attr values, like the log/slog package.
+func (l *Logger) Debug(message string, args ...any) {
+	l.log(LevelDebug, message, args)
+}
+
+func (l *Logger) Info(message string, args ...any) {
+	l.log(LevelInfo, message, args)
+}
+
+func (l *Logger) Warn(message string, args ...any) {
+	l.log(LevelWarn, message, args)
+}
+
+func (l *Logger) Error(message string, args ...any) {
+	l.log(LevelError, message, args)
+}
+
+func (l *Logger) DebugContext(ctx context.Context, message string, args ...any) {
+	l.logContext(ctx, LevelDebug, message, args)
+}
+
+func (l *Logger) InfoContext(ctx context.Context, message string, args ...any) {
+	l.logContext(ctx, LevelInfo, message, args)
+}
+
+func (l *Logger) WarnContext(ctx context.Context, message string, args ...any) {
+	l.logContext(ctx, LevelWarn, message, args)
+}
+
+func (l *Logger) ErrorContext(ctx context.Context, message string, args ...any) {
+	l.logContext(ctx, LevelError, message, args)
+}
+
+func (l *Logger) log(level Level, message string, args []any) {
+	l.logContext(context.Background(), level, message, args)
+}
+
+func (l *Logger) logContext(ctx context.Context, level Level, message string, args []any) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var r slog.Record
+	r.Add(args...)
+
+	properties := map[string]any{}
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(properties, a)
+		return true
+	})
+
+	l.write(ctx, level, time.Now(), message, properties)
 }
 
 func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
+	return l.printContext(context.Background(), level, message, properties)
+}
 
-	if level < l.minLevel {
+func (l *Logger) printContext(ctx context.Context, level Level, message string, properties map[string]string) (int, error) {
+	if !l.Enabled(level) {
 		return 0, nil
 	}
 
+	return l.write(ctx, level, time.Now(), message, typedProperties(properties))
+}
+
+func typedProperties(properties map[string]string) map[string]any {
+	if len(properties) == 0 {
+		return nil
+	}
+
+	typed := make(map[string]any, len(properties))
+	for k, v := range properties {
+		typed[k] = v
+	}
+
+	return typed
+}
+
+func (l *Logger) write(ctx context.Context, level Level, t time.Time, message string, properties map[string]any) (int, error) {
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string         `json:"level"`
+		Time       string         `json:"time,omitempty"`
+		Message    string         `json:"message"`
+		RequestID  string         `json:"request_id,omitempty"`
+		UserID     int64          `json:"user_id,omitempty"`
+		TraceID    string         `json:"trace_id,omitempty"`
+		SpanID     string         `json:"span_id,omitempty"`
+		Properties map[string]any `json:"properties,omitempty"`
+		Trace      string         `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
-		Time:       time.Now().Format(time.RFC3339),
 		Message:    message,
 		Properties: properties,
 	}
 
-	if level >= LevelError {
+	if !t.IsZero() {
+		aux.Time = t.Format(time.RFC3339)
+	}
+
+	if l.correlation != nil {
+		c := l.correlation(ctx)
+		aux.RequestID = c.RequestID
+		aux.UserID = c.UserID
+	}
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		aux.TraceID = sc.TraceID().String()
+		aux.SpanID = sc.SpanID().String()
+	}
+
+	if level >= LevelError && l.stackTraces.Load() {
 		aux.Trace = string(debug.Stack())
 	}
 
@@ -92,6 +296,7 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	return l.out.Write(append(line, '\n'))
 }
 
+// Write lets the logger be the error log of http.Server.
 func (l *Logger) Write(message []byte) (n int, err error) {
-	return l.print(LevelError, string(message), nil)
+	return l.print(LevelError, strings.TrimSuffix(string(message), "\n"), nil)
 }
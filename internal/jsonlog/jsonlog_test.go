@@ -0,0 +1,28 @@
+package jsonlog
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPrintAuditContextIgnoresLevel(t *testing.T) {
+	for _, level := range []Level{LevelInfo, LevelError, LevelOff} {
+		t.Run(level.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			l := New(&buf, level)
+
+			l.PrintInfoContext(context.Background(), "regular entry", nil)
+			l.PrintAuditContext(context.Background(), "admin action", map[string]string{"action": "set_log_level"})
+
+			if level > LevelInfo && strings.Contains(buf.String(), "regular entry") {
+				t.Errorf("info entry written at level %s", level)
+			}
+
+			if !strings.Contains(buf.String(), `"level":"INFO","time"`) || !strings.Contains(buf.String(), `"message":"admin action","properties":{"action":"set_log_level"}`) {
+				t.Errorf("audit entry missing at level %s: %s", level, buf.String())
+			}
+		})
+	}
+}
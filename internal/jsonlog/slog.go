@@ -0,0 +1,146 @@
+package jsonlog
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Handler is a slog.Handler that writes through a Logger, so libraries that
+// log with log/slog produce the same entries as the application.
+type Handler struct {
+	logger *Logger
+	attrs  []slog.Attr
+	groups []string
+}
+
+// Handler returns a slog.Handler writing to l.
+func (l *Logger) Handler() *Handler {
+	return &Handler{logger: l}
+}
+
+func levelFromSlog(level slog.Level) Level {
+	switch {
+	case level < slog.LevelInfo:
+		return LevelDebug
+	case level < slog.LevelWarn:
+		return LevelInfo
+	case level < slog.LevelError:
+		return LevelWarn
+	default:
+		return LevelError
+	}
+}
+
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.logger.Enabled(levelFromSlog(level))
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	properties := map[string]any{}
+
+	// attributes of the record go into the innermost group
+	target := properties
+	for _, a := range h.attrs {
+		addAttr(target, a)
+	}
+
+	if r.NumAttrs() > 0 {
+		for _, group := range h.groups {
+			nested, ok := target[group].(map[string]any)
+			if !ok {
+				nested = map[string]any{}
+				target[group] = nested
+			}
+			target = nested
+		}
+
+		r.Attrs(func(a slog.Attr) bool {
+			addAttr(target, a)
+			return true
+		})
+	}
+
+	_, err := h.logger.write(ctx, levelFromSlog(r.Level), r.Time, r.Message, properties)
+	return err
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+
+	// attributes are wrapped in the current groups so Handle can add them
+	// at the top level
+	wrapped := make([]any, 0, len(attrs))
+	for _, a := range attrs {
+		wrapped = append(wrapped, a)
+	}
+
+	attr := slog.Group("", wrapped...)
+	for i := len(h.groups) - 1; i >= 0; i-- {
+		attr = slog.Group(h.groups[i], attr)
+	}
+
+	h2 := *h
+	h2.attrs = append(append([]slog.Attr{}, h.attrs...), attr)
+
+	return &h2
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.groups = append(append([]string{}, h.groups...), name)
+
+	return &h2
+}
+
+// addAttr adds a to properties, resolving LogValuers and nesting groups.
+func addAttr(properties map[string]any, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		attrs := a.Value.Group()
+		if len(attrs) == 0 {
+			return
+		}
+
+		// groups without a name are inlined
+		target := properties
+		if a.Key != "" {
+			nested, ok := properties[a.Key].(map[string]any)
+			if !ok {
+				nested = map[string]any{}
+				properties[a.Key] = nested
+			}
+			target = nested
+		}
+
+		for _, ga := range attrs {
+			addAttr(target, ga)
+		}
+
+	case slog.KindTime:
+		properties[a.Key] = a.Value.Time().Format(time.RFC3339)
+
+	case slog.KindDuration:
+		properties[a.Key] = a.Value.Duration().String()
+
+	default:
+		value := a.Value.Any()
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+
+		properties[a.Key] = value
+	}
+}
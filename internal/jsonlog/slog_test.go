@@ -0,0 +1,112 @@
+package jsonlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"testing/slogtest"
+)
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+
+	newHandler := func(t *testing.T) slog.Handler {
+		buf.Reset()
+		return New(&buf, LevelDebug).Handler()
+	}
+
+	// slogtest expects the attributes at the top level, next to the
+	// level, time and msg keys
+	result := func(t *testing.T) map[string]any {
+		var entry struct {
+			Level      string         `json:"level"`
+			Time       string         `json:"time"`
+			Message    string         `json:"message"`
+			Properties map[string]any `json:"properties"`
+		}
+
+		err := json.Unmarshal(buf.Bytes(), &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := map[string]any{
+			slog.LevelKey:   entry.Level,
+			slog.MessageKey: entry.Message,
+		}
+
+		if entry.Time != "" {
+			m[slog.TimeKey] = entry.Time
+		}
+
+		for k, v := range entry.Properties {
+			m[k] = v
+		}
+
+		return m
+	}
+
+	slogtest.Run(t, newHandler, result)
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelWarn)
+
+	logger.PrintInfo("dropped", nil)
+	logger.Debug("dropped")
+	logger.Warn("kept", "attempts", 3)
+
+	if strings.Count(buf.String(), "\n") != 1 || !strings.Contains(buf.String(), `"attempts":3`) {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+
+	logger.SetLevel(LevelDebug)
+	buf.Reset()
+
+	logger.Debug("kept")
+	if !strings.Contains(buf.String(), `"level":"DEBUG"`) {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for l := LevelDebug; l <= LevelOff; l++ {
+		got, err := ParseLevel(strings.ToLower(l.String()))
+		if err != nil || got != l {
+			t.Errorf("ParseLevel(%q) = %v, %v", l.String(), got, err)
+		}
+	}
+
+	_, err := ParseLevel("verbose")
+	if err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
+
+func TestCorrelation(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+
+	type key struct{}
+
+	logger.SetCorrelation(func(ctx context.Context) Correlation {
+		id, _ := ctx.Value(key{}).(string)
+		return Correlation{RequestID: id, UserID: 42}
+	})
+
+	ctx := context.WithValue(context.Background(), key{}, "req-1")
+
+	slog.New(logger.Handler()).InfoContext(ctx, "handled")
+	logger.PrintErrorContext(ctx, errors.New("failed"), nil)
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.Contains(line, `"request_id":"req-1"`) || !strings.Contains(line, `"user_id":42`) {
+			t.Errorf("entry without correlation ids: %s", line)
+		}
+	}
+}
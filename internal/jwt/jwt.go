@@ -0,0 +1,341 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+var encoding = base64.RawURLEncoding
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type Claims struct {
+	Issuer      string   `json:"iss,omitempty"`
+	Subject     string   `json:"sub"`
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+	ID          string   `json:"jti,omitempty"`
+	Activated   bool     `json:"activated"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+func (c Claims) UserID() (int64, error) {
+	return strconv.ParseInt(c.Subject, 10, 64)
+}
+
+func (c Claims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// Key is a single signing key. HS256 keys hold a shared secret, EdDSA keys
+// hold a public key and, unless the key was retired, the private key.
+type Key struct {
+	ID      string
+	Alg     string
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+func (k *Key) canSign() bool {
+	switch k.Alg {
+	case AlgHS256:
+		return len(k.secret) > 0
+	case AlgEdDSA:
+		return k.private != nil
+	default:
+		return false
+	}
+}
+
+func (k *Key) sign(input []byte) ([]byte, error) {
+	switch k.Alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case AlgEdDSA:
+		return ed25519.Sign(k.private, input), nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", k.Alg)
+	}
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	switch k.Alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return hmac.Equal(signature, mac.Sum(nil))
+	case AlgEdDSA:
+		return ed25519.Verify(k.public, input, signature)
+	default:
+		return false
+	}
+}
+
+// KeySet signs tokens with its active key and verifies tokens signed by any
+// of its keys, which allows keys to be rotated without invalidating tokens
+// that are still in flight.
+type KeySet struct {
+	issuer string
+	active *Key
+	keys   map[string]*Key
+}
+
+// LoadKeySet reads every key in dir. The file name without extension is the
+// key ID: "<kid>.key" files hold an HS256 secret and "<kid>.pem" files hold a
+// PKCS8 Ed25519 private key or, for retired keys, a PKIX public key. When
+// activeKID is empty the directory must contain exactly one signing key.
+func LoadKeySet(dir, activeKID, issuer string) (*KeySet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{
+		issuer: issuer,
+		keys:   make(map[string]*Key),
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		ext := filepath.Ext(entry.Name())
+		if ext != ".key" && ext != ".pem" {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		kid := strings.TrimSuffix(entry.Name(), ext)
+
+		var key *Key
+		switch ext {
+		case ".key":
+			key, err = parseHMACKey(kid, content)
+		case ".pem":
+			key, err = parseEd25519Key(kid, content)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %q: %w", entry.Name(), err)
+		}
+
+		if _, exists := ks.keys[kid]; exists {
+			return nil, fmt.Errorf("jwt key %q: duplicate key id", kid)
+		}
+
+		ks.keys[kid] = key
+	}
+
+	if activeKID == "" {
+		var signers []string
+		for kid, key := range ks.keys {
+			if key.canSign() {
+				signers = append(signers, kid)
+			}
+		}
+
+		if len(signers) != 1 {
+			sort.Strings(signers)
+			return nil, fmt.Errorf("jwt: expected exactly one signing key in %s, found %v, set the active key id", dir, signers)
+		}
+
+		activeKID = signers[0]
+	}
+
+	active, ok := ks.keys[activeKID]
+	if !ok {
+		return nil, fmt.Errorf("jwt: active key %q not found in %s", activeKID, dir)
+	}
+
+	if !active.canSign() {
+		return nil, fmt.Errorf("jwt: active key %q has no private part", activeKID)
+	}
+
+	ks.active = active
+
+	return ks, nil
+}
+
+func parseHMACKey(kid string, content []byte) (*Key, error) {
+	secret := []byte(strings.TrimSpace(string(content)))
+	if len(secret) < 32 {
+		return nil, errors.New("HS256 secret must be at least 32 bytes long")
+	}
+
+	return &Key{ID: kid, Alg: AlgHS256, secret: secret}, nil
+}
+
+func parseEd25519Key(kid string, content []byte) (*Key, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not an Ed25519 key")
+		}
+
+		return &Key{ID: kid, Alg: AlgEdDSA, private: private, public: private.Public().(ed25519.PublicKey)}, nil
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		public, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not an Ed25519 key")
+		}
+
+		return &Key{ID: kid, Alg: AlgEdDSA, public: public}, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+func (ks *KeySet) ActiveKeyID() string {
+	return ks.active.ID
+}
+
+// Sign fills in the registered claims and returns a compact serialized token.
+func (ks *KeySet) Sign(claims Claims, ttl time.Duration) (string, error) {
+	now := time.Now()
+
+	claims.Issuer = ks.issuer
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(ttl).Unix()
+
+	jti := make([]byte, 16)
+	_, err := rand.Read(jti)
+	if err != nil {
+		return "", err
+	}
+	claims.ID = encoding.EncodeToString(jti)
+
+	h, err := json.Marshal(header{Alg: ks.active.Alg, Typ: "JWT", Kid: ks.active.ID})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+
+	signature, err := ks.active.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature, issuer and expiry of token and returns its
+// claims. The algorithm in the header must match the algorithm of the key it
+// names, so a token can not downgrade the verification method.
+func (ks *KeySet) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	rawHeader, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := json.Unmarshal(rawHeader, &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, ok := ks.keys[h.Kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	if h.Alg != key.Alg {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	rawClaims, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if ks.issuer != "" && claims.Issuer != ks.issuer {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
+
+// IsJWT reports whether token looks like a compact serialized JWT rather than
+// an opaque token.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,183 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeHMACKey(t *testing.T, dir, kid string) {
+	t.Helper()
+
+	err := os.WriteFile(filepath.Join(dir, kid+".key"), []byte(strings.Repeat("s", 32)+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeEd25519Key(t *testing.T, dir, kid string) {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, kid+".pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	for _, alg := range []string{AlgHS256, AlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			dir := t.TempDir()
+			if alg == AlgHS256 {
+				writeHMACKey(t, dir, "k1")
+			} else {
+				writeEd25519Key(t, dir, "k1")
+			}
+
+			ks, err := LoadKeySet(dir, "", "greenlight")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := ks.Sign(Claims{Subject: "42", Activated: true, Permissions: []string{"movies:read"}}, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !IsJWT(token) {
+				t.Fatalf("%q does not look like a jwt", token)
+			}
+
+			claims, err := ks.Verify(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := claims.UserID()
+			if err != nil || id != 42 {
+				t.Errorf("got user id %d (%v), want 42", id, err)
+			}
+
+			if claims.Issuer != "greenlight" || !claims.Activated || !slices.Equal(claims.Permissions, []string{"movies:read"}) {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
+
+// resign replaces the header of token and signs it again with key, which
+// is what an attacker holding a key of another key set could do.
+func resign(t *testing.T, key *Key, token string, h header) string {
+	t.Helper()
+
+	raw, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := encoding.EncodeToString(raw) + "." + strings.Split(token, ".")[1]
+
+	signature, err := key.sign([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return input + "." + encoding.EncodeToString(signature)
+}
+
+func TestVerifyRejects(t *testing.T) {
+	dir := t.TempDir()
+	writeEd25519Key(t, dir, "ed")
+	writeHMACKey(t, dir, "hs")
+
+	ks, err := LoadKeySet(dir, "ed", "greenlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := ks.Sign(Claims{Subject: "42"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := ks.Sign(Claims{Subject: "42"}, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	payload, _ := encoding.DecodeString(parts[1])
+	tampered := parts[0] + "." + encoding.EncodeToString([]byte(strings.Replace(string(payload), `"sub":"42"`, `"sub":"1"`, 1))) + "." + parts[2]
+
+	otherIssuer, err := LoadKeySet(dir, "ed", "someone-else")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foreign, err := otherIssuer.Sign(Claims{Subject: "42"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"tampered payload", tampered, ErrInvalidToken},
+		{"expired", expired, ErrExpiredToken},
+		{"unknown kid", resign(t, ks.keys["ed"], token, header{Alg: AlgEdDSA, Typ: "JWT", Kid: "missing"}), ErrUnknownKey},
+		{"wrong alg for key", resign(t, ks.keys["hs"], token, header{Alg: AlgHS256, Typ: "JWT", Kid: "ed"}), ErrInvalidToken},
+		{"none alg", encoding.EncodeToString([]byte(`{"alg":"none","kid":"ed"}`)) + "." + parts[1] + ".", ErrInvalidToken},
+		{"wrong issuer", foreign, ErrInvalidToken},
+		{"malformed", "a.b", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadKeySetRequiresActiveKey(t *testing.T) {
+	dir := t.TempDir()
+	writeEd25519Key(t, dir, "a")
+	writeHMACKey(t, dir, "b")
+
+	_, err := LoadKeySet(dir, "", "greenlight")
+	if err == nil {
+		t.Fatal("expected an error for several signing keys without an active key id")
+	}
+
+	ks, err := LoadKeySet(dir, "b", "greenlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ks.ActiveKeyID() != "b" {
+		t.Errorf("got active key %q, want b", ks.ActiveKeyID())
+	}
+}
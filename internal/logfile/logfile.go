@@ -0,0 +1,371 @@
+// Package logfile provides an io.Writer that appends to a log file and
+// rotates it by size or day. Rotated files are optionally compressed and
+// removed once they are too old or too many.
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is part of the name of rotated files, it sorts in
+// rotation order and contains no characters that are invalid in file names.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+var ErrClosed = errors.New("log file closed")
+
+type Options struct {
+	// MaxSize is the size in bytes a file grows to before it is rotated, 0
+	// disables size based rotation.
+	MaxSize int64
+	// Daily rotates the file when the first entry of a new day is written.
+	Daily bool
+	// MaxAge removes rotated files older than it, 0 keeps them.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept, 0 keeps all of them.
+	MaxBackups int
+	// Compress gzips rotated files.
+	Compress bool
+	// OnRotateError is called with the error of a failed rotation, Write
+	// keeps appending to the current file and does not return it. It must
+	// not write to the file itself.
+	OnRotateError func(error)
+}
+
+type File struct {
+	path string
+	opts Options
+	now  func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	day  string
+
+	mill chan struct{}
+	done chan struct{}
+}
+
+// Open opens path for appending, creating it and its directory when needed.
+func Open(path string, opts Options) (*File, error) {
+	f := &File{
+		path: path,
+		opts: opts,
+		now:  time.Now,
+		mill: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	go f.runMill()
+
+	// backups left over from an earlier run may still need compressing or
+	// removing
+	f.triggerMill()
+
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.day = dayOf(f.now())
+
+	// a file last written on an earlier day is rotated with the next write
+	if info.Size() > 0 {
+		f.day = dayOf(info.ModTime())
+	}
+
+	return nil
+}
+
+func dayOf(t time.Time) string {
+	return t.Format(time.DateOnly)
+}
+
+// Write appends p to the file, rotating it first when p would exceed the
+// maximum size or a new day started. A single write is never split between
+// two files. When rotating fails p is still written to the current file, the
+// error goes to OnRotateError and rotating is tried again with the next write.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+
+	if f.file == nil {
+		f.mu.Unlock()
+		return 0, ErrClosed
+	}
+
+	sizeExceeded := f.opts.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.opts.MaxSize
+	dayChanged := f.opts.Daily && f.size > 0 && dayOf(f.now()) != f.day
+
+	var rotateErr error
+	if sizeExceeded || dayChanged {
+		rotateErr = f.rotate()
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	f.mu.Unlock()
+
+	if rotateErr != nil && f.opts.OnRotateError != nil {
+		f.opts.OnRotateError(rotateErr)
+	}
+
+	return n, err
+}
+
+// Rotate moves the current file aside and starts a new one.
+func (f *File) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return ErrClosed
+	}
+
+	return f.rotate()
+}
+
+// rotate moves the file aside while it is still open and only closes it once
+// the new file is open, so when either step fails logging goes on to the
+// current file.
+func (f *File) rotate() error {
+	err := os.Rename(f.path, f.backupName(f.now()))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = f.reopen()
+	if err != nil {
+		return err
+	}
+
+	f.triggerMill()
+
+	return nil
+}
+
+// Reopen closes and reopens the file without rotating it, so it follows an
+// external tool like logrotate that moved the file away. The current file
+// is kept when the new one can not be opened.
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return ErrClosed
+	}
+
+	return f.reopen()
+}
+
+func (f *File) reopen() error {
+	old := f.file
+
+	err := f.open()
+	if err != nil {
+		return err
+	}
+
+	return old.Close()
+}
+
+// Close closes the file and waits for pending compression to finish.
+func (f *File) Close() error {
+	f.mu.Lock()
+
+	if f.file == nil {
+		f.mu.Unlock()
+		return ErrClosed
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	close(f.mill)
+	f.mu.Unlock()
+
+	<-f.done
+
+	return err
+}
+
+// backupName returns the name of the file rotated at t, app.log becomes
+// app-2006-01-02T15-04-05.000.log.
+func (f *File) backupName(t time.Time) string {
+	prefix, ext := f.backupAffixes()
+	return prefix + t.Format(backupTimeFormat) + ext
+}
+
+func (f *File) backupAffixes() (string, string) {
+	ext := filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-", ext
+}
+
+func (f *File) triggerMill() {
+	select {
+	case f.mill <- struct{}{}:
+	default:
+	}
+}
+
+// runMill compresses and removes rotated files outside of Write, so
+// rotating does not block logging.
+func (f *File) runMill() {
+	defer close(f.done)
+
+	for range f.mill {
+		f.millBackups()
+	}
+}
+
+type backup struct {
+	path       string
+	rotatedAt  time.Time
+	compressed bool
+}
+
+func (f *File) millBackups() {
+	backups, err := f.backups()
+	if err != nil {
+		return
+	}
+
+	var keep []backup
+	cutoff := time.Now().Add(-f.opts.MaxAge)
+
+	// backups are sorted newest first
+	for i, b := range backups {
+		tooMany := f.opts.MaxBackups > 0 && i >= f.opts.MaxBackups
+		tooOld := f.opts.MaxAge > 0 && b.rotatedAt.Before(cutoff)
+
+		if tooMany || tooOld {
+			os.Remove(b.path)
+			continue
+		}
+
+		keep = append(keep, b)
+	}
+
+	if !f.opts.Compress {
+		return
+	}
+
+	for _, b := range keep {
+		if !b.compressed {
+			compress(b.path)
+		}
+	}
+}
+
+// backups lists the rotated files, newest first.
+func (f *File) backups() ([]backup, error) {
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, ext := f.backupAffixes()
+	prefix = filepath.Base(prefix)
+
+	var backups []backup
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+		b := backup{path: filepath.Join(filepath.Dir(f.path), name)}
+
+		if strings.HasSuffix(name, ".gz") {
+			name = strings.TrimSuffix(name, ".gz")
+			b.compressed = true
+		}
+
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+
+		b.rotatedAt, err = time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, b)
+	}
+
+	slices.SortFunc(backups, func(a, b backup) int {
+		return b.rotatedAt.Compare(a.rotatedAt)
+	})
+
+	return backups, nil
+}
+
+// compress replaces path with a gzipped copy. The copy is written to a
+// temporary file first, so an interrupted run never leaves a truncated
+// archive behind.
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path+".gz")
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
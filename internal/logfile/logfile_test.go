@@ -0,0 +1,287 @@
+package logfile
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func backupNames(t *testing.T, f *File) []string {
+	t.Helper()
+
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, b := range backups {
+		names = append(names, filepath.Base(b.path))
+	}
+
+	return names
+}
+
+func TestSizeRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+
+	f, err := Open(path, Options{MaxSize: 10, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+	f.now = func() time.Time { return now }
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		now = now.Add(time.Second)
+
+		_, err := f.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(current) != "fourth\n" {
+		t.Errorf("current file contains %q, want %q", current, "fourth\n")
+	}
+
+	// the first file exceeds the two kept backups, the others are compressed
+	want := []string{"app-2026-10-19T12-00-04.000.log.gz", "app-2026-10-19T12-00-03.000.log.gz"}
+	if got := backupNames(t, f); !slices.Equal(got, want) {
+		t.Fatalf("got backups %v, want %v", got, want)
+	}
+
+	gz, err := os.Open(filepath.Join(filepath.Dir(path), want[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gz.Close()
+
+	zr, err := gzip.NewReader(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "third\n" {
+		t.Errorf("newest backup contains %q, want %q", content, "third\n")
+	}
+}
+
+func TestDailyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+
+	f, err := Open(path, Options{Daily: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	now := time.Date(2026, 10, 19, 23, 59, 0, 0, time.Local)
+	f.now = func() time.Time { return now }
+	f.day = dayOf(now)
+
+	f.Write([]byte("monday\n"))
+	f.Write([]byte("still monday\n"))
+
+	now = now.Add(2 * time.Minute)
+	f.Write([]byte("tuesday\n"))
+
+	want := []string{"app-2026-10-20T00-01-00.000.log"}
+	if got := backupNames(t, f); !slices.Equal(got, want) {
+		t.Fatalf("got backups %v, want %v", got, want)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(current) != "tuesday\n" {
+		t.Errorf("current file contains %q, want %q", current, "tuesday\n")
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+
+	old := filepath.Join(dir, "app-"+time.Now().Add(-48*time.Hour).Format(backupTimeFormat)+".log.gz")
+	recent := filepath.Join(dir, "app-"+time.Now().Add(-time.Hour).Format(backupTimeFormat)+".log.gz")
+	other := filepath.Join(dir, "other.log")
+
+	for _, name := range []string{old, recent, other} {
+		err := os.WriteFile(name, nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := Open(path, Options{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close waits for the clean up Open started
+	f.Close()
+
+	want := []string{filepath.Base(recent)}
+	if got := backupNames(t, f); !slices.Equal(got, want) {
+		t.Fatalf("got backups %v, want %v", got, want)
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("unrelated file was removed: %v", err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+
+	f, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("before\n"))
+
+	// what logrotate does before sending SIGHUP
+	err = os.Rename(path, path+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("after\n"))
+
+	for name, want := range map[string]string{path + ".1": "before\n", path: "after\n"} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != want {
+			t.Errorf("%s contains %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+}
+
+func TestFailedRotationKeepsLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+
+	var rotateErrs []error
+
+	f, err := Open(path, Options{MaxSize: 10, OnRotateError: func(err error) { rotateErrs = append(rotateErrs, err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+	f.now = func() time.Time { return now }
+
+	// a directory in the way of the backup makes renaming fail
+	err = os.Mkdir(f.backupName(now), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Write([]byte("first\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := f.Write([]byte("second\n"))
+	if err != nil || n != len("second\n") {
+		t.Errorf("got %d, %v, want %d, nil", n, err, len("second\n"))
+	}
+
+	if len(rotateErrs) != 1 {
+		t.Errorf("got %d rotation errors, want 1", len(rotateErrs))
+	}
+
+	// rotating succeeds once the way is clear
+	now = now.Add(time.Second)
+
+	_, err = f.Write([]byte("third\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{f.backupName(now): "first\nsecond\n", path: "third\n"} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != want {
+			t.Errorf("%s contains %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+}
+
+func TestFailedReopenKeepsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+
+	f, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	err = os.Rename(path, path+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory where the log file should be can not be opened for writing
+	err = os.Mkdir(path, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Reopen()
+	if err == nil {
+		t.Fatal("expected an error reopening a directory")
+	}
+
+	_, err = f.Write([]byte("still logged\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "still logged\n" {
+		t.Errorf("old file contains %q, want %q", got, "still logged\n")
+	}
+}
@@ -0,0 +1,49 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileTransport writes every message as an .eml file to Dir, which mail
+// clients can open directly.
+type FileTransport struct {
+	Dir string
+}
+
+func NewFileTransport(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileTransport{Dir: dir}, nil
+}
+
+func (t *FileTransport) Send(msg *Message) error {
+	suffix := make([]byte, 4)
+
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+
+	f, err := os.OpenFile(filepath.Join(t.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = msg.mime().WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
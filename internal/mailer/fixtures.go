@@ -0,0 +1,37 @@
+package mailer
+
+// fixtures holds sample data for every template. It is used to preview
+// templates and in tests, so every template needs an entry here.
+var fixtures = map[string]map[string]any{
+	"account_locked.tmpl.html": {
+		"attempts":    10,
+		"ip":          "203.0.113.7",
+		"lockedUntil": "Mon, 02 Jan 2006 15:04:05 UTC",
+	},
+	"movie_digest.tmpl.html": {
+		"name":      "Alice",
+		"frequency": "weekly",
+		"movies": []map[string]any{
+			{"title": "Moana", "year": 2016, "genres": "animation, adventure"},
+			{"title": "Black Panther", "year": 2018, "genres": "action, adventure"},
+		},
+		"unsubscribeURL": "https://greenlight.example.com/v1/notifications/unsubscribe?token=1.c2lnbmF0dXJl",
+	},
+	"token_magic_link.tmpl.html": {
+		"magicLinkToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		"ttl":            "15m0s",
+	},
+	"token_password_reset.tmpl.html": {
+		"passwordResetToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	},
+	"user_welcome.tmpl.html": {
+		"userID":          1,
+		"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	},
+}
+
+// Fixture returns the sample data for templateFile.
+func Fixture(templateFile string) (map[string]any, bool) {
+	data, ok := fixtures[templateFile]
+	return data, ok
+}
@@ -0,0 +1,97 @@
+package mailer
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLocale is the last entry of every fallback chain, every template
+// must exist in it.
+const DefaultLocale = "en"
+
+// PreferredLanguage returns the language tag with the highest quality value
+// in an Accept-Language header, or an empty string if there is none.
+func PreferredLanguage(acceptLanguage string) string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var tags []weighted
+
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+
+		if tag == "" || tag == "*" || len(tag) > 35 {
+			continue
+		}
+
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		if q <= 0 {
+			continue
+		}
+
+		tags = append(tags, weighted{tag: CanonicalLocale(tag), q: q})
+	}
+
+	// stable, so tags with the same weight keep the order of the header
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+
+	if len(tags) == 0 {
+		return ""
+	}
+
+	return tags[0].tag
+}
+
+// CanonicalLocale normalizes the case of a language tag, so "EN-us" and
+// "en-US" name the same template set.
+func CanonicalLocale(locale string) string {
+	parts := strings.Split(strings.ReplaceAll(locale, "_", "-"), "-")
+
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		} else {
+			parts[i] = strings.ToLower(parts[i])
+		}
+	}
+
+	return strings.Join(parts, "-")
+}
+
+// fallbackChain lists the locales tried for locale, most specific first:
+// "de-AT" falls back to "de" and then to the default locale.
+func fallbackChain(locale string) []string {
+	var chain []string
+
+	locale = CanonicalLocale(locale)
+	for locale != "" {
+		chain = append(chain, locale)
+
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+
+	if len(chain) == 0 || chain[len(chain)-1] != DefaultLocale {
+		chain = append(chain, DefaultLocale)
+	}
+
+	return chain
+}
@@ -0,0 +1,22 @@
+package mailer
+
+// Logger is the part of jsonlog.Logger the log transport needs.
+type Logger interface {
+	PrintInfo(message string, properties map[string]string)
+}
+
+// LogTransport does not deliver anything, it only logs who would have
+// received which message.
+type LogTransport struct {
+	Logger Logger
+}
+
+func (t *LogTransport) Send(msg *Message) error {
+	t.Logger.PrintInfo("email not sent (log transport)", map[string]string{
+		"to":       msg.To,
+		"subject":  msg.Subject,
+		"template": msg.Template,
+	})
+
+	return nil
+}
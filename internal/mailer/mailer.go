@@ -3,76 +3,207 @@ package mailer
 import (
 	"bytes"
 	"embed"
+	"errors"
+	"fmt"
 	"html/template"
-	"time"
-
-	"gopkg.in/mail.v2"
+	"io/fs"
+	"path"
+	"sort"
 )
 
+// templates are stored per locale, as templates/<locale>/<file>
+//
 //go:embed "templates"
 var templateFS embed.FS
 
+var ErrUnknownTemplate = errors.New("unknown email template")
+
+// Message is a rendered email, ready to be handed to a Transport.
+type Message struct {
+	To        string
+	From      string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+	Template  string
+	Locale    string
+
+	// ListUnsubscribe is the one-click unsubscribe url, if the message has one.
+	ListUnsubscribe string
+}
+
+// Transport delivers rendered messages.
+type Transport interface {
+	Send(msg *Message) error
+}
+
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	transport Transport
+	sender    string
+
+	// locale -> template file -> parsed template
+	templates map[string]map[string]*template.Template
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	dialer := mail.NewDialer(host, port, username, password)
+// New parses every embedded template once, so a broken template stops the
+// application at startup instead of failing when the email is sent.
+func New(transport Transport, sender string) (Mailer, error) {
+	templates, err := parseTemplates(templateFS)
+	if err != nil {
+		return Mailer{}, err
+	}
 
-	dialer.Timeout = 5 * time.Second
+	if _, ok := templates[DefaultLocale]; !ok {
+		return Mailer{}, fmt.Errorf("mailer: no templates for the default locale %q", DefaultLocale)
+	}
 
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		transport: transport,
+		sender:    sender,
+		templates: templates,
+	}, nil
+}
+
+func parseTemplates(fsys fs.FS) (map[string]map[string]*template.Template, error) {
+	templates := make(map[string]map[string]*template.Template)
+
+	locales, err := fs.ReadDir(fsys, "templates")
+	if err != nil {
+		return nil, err
 	}
+
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+
+		files, err := fs.Glob(fsys, path.Join("templates", locale.Name(), "*.tmpl.html"))
+		if err != nil {
+			return nil, err
+		}
+
+		name := CanonicalLocale(locale.Name())
+		templates[name] = make(map[string]*template.Template)
+
+		for _, file := range files {
+			tmpl, err := template.New("email").Option("missingkey=error").ParseFS(fsys, file)
+			if err != nil {
+				return nil, err
+			}
+
+			templates[name][path.Base(file)] = tmpl
+		}
+	}
+
+	return templates, nil
 }
 
-func (m Mailer) Send(recipient, templateFile string, data any) error {
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// Locales returns the locales templates exist for, sorted.
+func (m Mailer) Locales() []string {
+	locales := make([]string, 0, len(m.templates))
+	for locale := range m.templates {
+		locales = append(locales, locale)
+	}
+
+	sort.Strings(locales)
 
+	return locales
+}
+
+// Templates returns the template files of the default locale, sorted.
+func (m Mailer) Templates() []string {
+	files := make([]string, 0, len(m.templates[DefaultLocale]))
+	for file := range m.templates[DefaultLocale] {
+		files = append(files, file)
+	}
+
+	sort.Strings(files)
+
+	return files
+}
+
+// TemplateLocales returns the locales templateFile is translated to, sorted.
+func (m Mailer) TemplateLocales(templateFile string) []string {
+	locales := []string{}
+	for _, locale := range m.Locales() {
+		if _, ok := m.templates[locale][templateFile]; ok {
+			locales = append(locales, locale)
+		}
+	}
+
+	return locales
+}
+
+// lookup returns the template for the most specific locale in the fallback
+// chain of locale that has it.
+func (m Mailer) lookup(locale, templateFile string) (*template.Template, string, error) {
+	for _, candidate := range fallbackChain(locale) {
+		tmpl, ok := m.templates[candidate][templateFile]
+		if ok {
+			return tmpl, candidate, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("%w: %s", ErrUnknownTemplate, templateFile)
+}
+
+func (m Mailer) Send(recipient, locale, templateFile string, data any) error {
+	msg, err := m.Render(recipient, locale, templateFile, data)
 	if err != nil {
 		return err
 	}
 
+	return m.Deliver(msg)
+}
+
+// Deliver hands an already rendered message to the transport.
+func (m Mailer) Deliver(msg *Message) error {
+	return m.transport.Send(msg)
+}
+
+// Render executes the subject, plainBody and htmlBody templates of
+// templateFile in the given locale without sending anything. An
+// "unsubscribeURL" entry in map data becomes the List-Unsubscribe header.
+func (m Mailer) Render(recipient, locale, templateFile string, data any) (*Message, error) {
+	tmpl, resolved, err := m.lookup(locale, templateFile)
+	if err != nil {
+		return nil, err
+	}
+
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	for i := 1; i <= 3; i++ {
-
-		err = m.dialer.DialAndSend(msg)
-
-		if nil == err {
-			return nil
-		}
-		time.Sleep(2 * time.Second)
+	msg := &Message{
+		To:        recipient,
+		From:      m.sender,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+		Template:  templateFile,
+		Locale:    resolved,
 	}
 
-	return err
+	if values, ok := data.(map[string]any); ok {
+		msg.ListUnsubscribe, _ = values["unsubscribeURL"].(string)
+	}
 
+	return msg, nil
 }
@@ -0,0 +1,232 @@
+package mailer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestMailer(t *testing.T, transport Transport, sender string) Mailer {
+	t.Helper()
+
+	m, err := New(transport, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestMemoryTransport(t *testing.T) {
+	transport := NewMemoryTransport()
+	m := newTestMailer(t, transport, "Greenlight <hello@greenlight.test>")
+
+	err := m.Send("alice@example.com", "en", "user_welcome.tmpl.html", map[string]any{
+		"userID":          1,
+		"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := transport.AssertSent(t, "alice@example.com", "user_welcome.tmpl.html")
+
+	if !strings.Contains(msg.PlainBody, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+		t.Errorf("plain body does not contain the activation token:\n%s", msg.PlainBody)
+	}
+
+	if msg.From != "Greenlight <hello@greenlight.test>" {
+		t.Errorf("got sender %q", msg.From)
+	}
+
+	transport.AssertNotSent(t, "bob@example.com")
+	transport.AssertCount(t, 1)
+
+	transport.Reset()
+	transport.AssertCount(t, 0)
+}
+
+func TestFileTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+
+	transport, err := NewFileTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newTestMailer(t, transport, "hello@greenlight.test")
+
+	err = m.Send("alice@example.com", "en", "user_welcome.tmpl.html", map[string]any{
+		"userID":          1,
+		"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("got %d .eml files; want 1", len(files))
+	}
+
+	eml, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"To: alice@example.com", "From: hello@greenlight.test", "text/plain", "text/html"} {
+		if !strings.Contains(string(eml), want) {
+			t.Errorf("eml file does not contain %q", want)
+		}
+	}
+}
+
+func TestSendUnknownTemplate(t *testing.T) {
+	transport := NewMemoryTransport()
+	m := newTestMailer(t, transport, "hello@greenlight.test")
+
+	err := m.Send("alice@example.com", "en", "missing.tmpl.html", nil)
+	if !errors.Is(err, ErrUnknownTemplate) {
+		t.Fatalf("got error %v; want %v", err, ErrUnknownTemplate)
+	}
+
+	transport.AssertCount(t, 0)
+}
+
+func TestRenderAllTemplates(t *testing.T) {
+	m := newTestMailer(t, NewMemoryTransport(), "hello@greenlight.test")
+
+	for _, locale := range m.Locales() {
+		for file := range m.templates[locale] {
+			t.Run(locale+"/"+file, func(t *testing.T) {
+				data, ok := Fixture(file)
+				if !ok {
+					t.Fatalf("no fixture for %s", file)
+				}
+
+				msg, err := m.Render("alice@example.com", locale, file, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if msg.Locale != locale {
+					t.Errorf("rendered in %q; want %q", msg.Locale, locale)
+				}
+
+				if strings.TrimSpace(msg.Subject) == "" || strings.TrimSpace(msg.PlainBody) == "" || strings.TrimSpace(msg.HTMLBody) == "" {
+					t.Error("subject, plain body and html body must not be empty")
+				}
+			})
+		}
+	}
+}
+
+func TestLocalesOnlyTranslateDefaultTemplates(t *testing.T) {
+	m := newTestMailer(t, NewMemoryTransport(), "hello@greenlight.test")
+
+	for _, locale := range m.Locales() {
+		for file := range m.templates[locale] {
+			if _, ok := m.templates[DefaultLocale][file]; !ok {
+				t.Errorf("%s/%s has no %s version to fall back to", locale, file, DefaultLocale)
+			}
+		}
+	}
+}
+
+func TestLocaleFallback(t *testing.T) {
+	m := newTestMailer(t, NewMemoryTransport(), "hello@greenlight.test")
+
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		{"de", "de"},
+		{"de-AT", "de"},
+		{"ES-mx", "es"},
+		{"fr-FR", DefaultLocale},
+		{"", DefaultLocale},
+	}
+
+	data, _ := Fixture("user_welcome.tmpl.html")
+
+	for _, tt := range tests {
+		msg, err := m.Render("alice@example.com", tt.locale, "user_welcome.tmpl.html", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Locale != tt.want {
+			t.Errorf("locale %q rendered in %q; want %q", tt.locale, msg.Locale, tt.want)
+		}
+	}
+}
+
+func TestRenderMissingData(t *testing.T) {
+	m := newTestMailer(t, NewMemoryTransport(), "hello@greenlight.test")
+
+	_, err := m.Render("alice@example.com", "en", "user_welcome.tmpl.html", map[string]any{"userID": 1})
+	if err == nil {
+		t.Fatal("expected an error for missing template data")
+	}
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"de", "de"},
+		{"de-at,de;q=0.9,en;q=0.8", "de-AT"},
+		{"en;q=0.5, es-MX", "es-MX"},
+		{"fr;q=0, en;q=0.1", "en"},
+		{"*", ""},
+	}
+
+	for _, tt := range tests {
+		got := PreferredLanguage(tt.header)
+		if got != tt.want {
+			t.Errorf("PreferredLanguage(%q) = %q; want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestListUnsubscribeHeader(t *testing.T) {
+	dir := t.TempDir()
+
+	transport, err := NewFileTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newTestMailer(t, transport, "hello@greenlight.test")
+
+	data, _ := Fixture("movie_digest.tmpl.html")
+
+	err = m.Send("alice@example.com", "en", "movie_digest.tmpl.html", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("got %d .eml files; want 1", len(files))
+	}
+
+	eml, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"List-Unsubscribe: <" + data["unsubscribeURL"].(string) + ">", "List-Unsubscribe-Post: List-Unsubscribe=One-Click"} {
+		if !strings.Contains(string(eml), want) {
+			t.Errorf("eml file does not contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package mailer
+
+import (
+	"strings"
+	"sync"
+)
+
+// MemoryTransport keeps sent messages in memory so tests can make assertions
+// about them. It never forgets a message, so it is not offered by the server.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (t *MemoryTransport) Send(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = append(t.messages, *msg)
+	return nil
+}
+
+// Messages returns a copy of every message sent so far, oldest first.
+func (t *MemoryTransport) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	messages := make([]Message, len(t.messages))
+	copy(messages, t.messages)
+
+	return messages
+}
+
+// SentTo returns the messages sent to recipient, oldest first.
+func (t *MemoryTransport) SentTo(recipient string) []Message {
+	var messages []Message
+
+	for _, msg := range t.Messages() {
+		if strings.EqualFold(msg.To, recipient) {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages
+}
+
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = nil
+}
+
+// TB is the part of testing.TB the assertion helpers use, so this package
+// does not import testing.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+}
+
+// AssertSent fails the test unless a message rendered from templateFile was
+// sent to recipient, and returns the latest such message.
+func (t *MemoryTransport) AssertSent(tb TB, recipient, templateFile string) Message {
+	tb.Helper()
+
+	sent := t.SentTo(recipient)
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].Template == templateFile {
+			return sent[i]
+		}
+	}
+
+	tb.Fatalf("no %s email was sent to %s (%d emails sent to them)", templateFile, recipient, len(sent))
+	return Message{}
+}
+
+func (t *MemoryTransport) AssertNotSent(tb TB, recipient string) {
+	tb.Helper()
+
+	if sent := t.SentTo(recipient); len(sent) > 0 {
+		tb.Errorf("expected no email to %s, got %d (first subject %q)", recipient, len(sent), sent[0].Subject)
+	}
+}
+
+func (t *MemoryTransport) AssertCount(tb TB, want int) {
+	tb.Helper()
+
+	if got := len(t.Messages()); got != want {
+		tb.Errorf("got %d emails sent; want %d", got, want)
+	}
+}
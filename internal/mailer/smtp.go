@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	"time"
+
+	"gopkg.in/mail.v2"
+)
+
+// SMTPTransport sends messages through an SMTP server. Failed deliveries are
+// retried by the caller.
+type SMTPTransport struct {
+	dialer *mail.Dialer
+}
+
+func NewSMTPTransport(host string, port int, username, password string) *SMTPTransport {
+	dialer := mail.NewDialer(host, port, username, password)
+
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTPTransport{dialer: dialer}
+}
+
+func (t *SMTPTransport) Send(msg *Message) error {
+	return t.dialer.DialAndSend(msg.mime())
+}
+
+func (msg *Message) mime() *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", msg.From)
+	m.SetHeader("Subject", msg.Subject)
+
+	// RFC 8058 one-click unsubscribe
+	if msg.ListUnsubscribe != "" {
+		m.SetHeader("List-Unsubscribe", "<"+msg.ListUnsubscribe+">")
+		m.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+
+	return m
+}
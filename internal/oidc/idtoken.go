@@ -0,0 +1,199 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// clockSkew is tolerated between our clock and the one of the provider.
+const clockSkew = time.Minute
+
+// IDToken holds the verified claims of an id token that greenlight uses.
+type IDToken struct {
+	Issuer        string
+	Subject       string
+	Audience      []string
+	Expiry        time.Time
+	IssuedAt      time.Time
+	Nonce         string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var many []string
+	err := json.Unmarshal(b, &many)
+	if err != nil {
+		return err
+	}
+
+	*a = many
+	return nil
+}
+
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedBy  string   `json:"azp"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified any      `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// Verify checks the signature of raw against the provider keys and validates
+// the issuer, audience, expiry and nonce claims.
+func (p *Provider) Verify(ctx context.Context, raw, nonce string) (*IDToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	headerJSON, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var h struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	err = json.Unmarshal(headerJSON, &h)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := p.keys.key(ctx, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	if !verifySignature(h.Alg, key, digest[:], signature) {
+		return nil, ErrInvalidIDToken
+	}
+
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var claims idTokenClaims
+
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	return p.validateClaims(claims, nonce)
+}
+
+// verifySignature only accepts the asymmetric algorithms, so a token can
+// never be "signed" with alg none or with the public key as an HMAC secret.
+func verifySignature(alg string, key crypto.PublicKey, digest, signature []byte) bool {
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature) == nil
+
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+
+		return ecdsa.Verify(ecKey, digest, r, s)
+	}
+
+	return false
+}
+
+func (p *Provider) validateClaims(claims idTokenClaims, nonce string) (*IDToken, error) {
+	if claims.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, claims.Issuer)
+	}
+
+	if !slices.Contains(claims.Audience, p.config.ClientID) {
+		return nil, fmt.Errorf("%w: token was not issued for this client", ErrInvalidIDToken)
+	}
+
+	if len(claims.Audience) > 1 && claims.AuthorizedBy != p.config.ClientID {
+		return nil, fmt.Errorf("%w: unexpected authorized party %q", ErrInvalidIDToken, claims.AuthorizedBy)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+
+	now := p.now()
+	expiry := time.Unix(claims.ExpiresAt, 0)
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+
+	if now.After(expiry.Add(clockSkew)) {
+		return nil, ErrExpiredIDToken
+	}
+
+	if issuedAt.After(now.Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	}
+
+	if nonce != "" && claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	// some providers send email_verified as a string
+	verified := false
+	switch v := claims.EmailVerified.(type) {
+	case bool:
+		verified = v
+	case string:
+		verified = v == "true"
+	}
+
+	return &IDToken{
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Audience:      claims.Audience,
+		Expiry:        expiry,
+		IssuedAt:      issuedAt,
+		Nonce:         claims.Nonce,
+		Email:         claims.Email,
+		EmailVerified: verified,
+		Name:          claims.Name,
+	}, nil
+}
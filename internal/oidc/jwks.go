@@ -0,0 +1,156 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet caches the signing keys of the provider. Keys are fetched again once
+// the cache expired, or when a token is signed with an unknown key id, which
+// happens right after the provider rotated its keys.
+type keySet struct {
+	client *http.Client
+	uri    string
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func newKeySet(client *http.Client, uri string, ttl time.Duration, now func() time.Time) *keySet {
+	return &keySet{
+		client: client,
+		uri:    uri,
+		ttl:    ttl,
+		now:    now,
+		keys:   make(map[string]crypto.PublicKey),
+	}
+}
+
+// minRefetchInterval stops tokens with made up key ids from making us fetch
+// the key set on every request.
+const minRefetchInterval = 10 * time.Second
+
+func (s *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	expired := now.Sub(s.fetchedAt) > s.ttl
+
+	key, found := s.keys[kid]
+	if found && !expired {
+		return key, nil
+	}
+
+	if !expired && now.Sub(s.fetchedAt) < minRefetchInterval {
+		return nil, ErrUnknownKey
+	}
+
+	err := s.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key, found = s.keys[kid]
+	if !found {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+func (s *keySet) fetch(ctx context.Context) error {
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	err := getJSON(ctx, s.client, s.uri, &doc)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range doc.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			// keys of unsupported types are skipped, not fatal
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	s.keys = keys
+	s.fetchedAt = s.now()
+
+	return nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := encoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := encoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, ErrUnknownKey
+		}
+
+		x, err := encoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := encoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return nil, ErrUnknownKey
+}
@@ -0,0 +1,217 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("oidc: invalid id token")
+	ErrExpiredIDToken = errors.New("oidc: id token has expired")
+	ErrUnknownKey     = errors.New("oidc: unknown signing key")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Config describes a relying party registration at an OpenID provider.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// JWKSCacheTTL is how long fetched signing keys are trusted before they
+	// are fetched again. Unknown key ids always trigger a refetch.
+	JWKSCacheTTL time.Duration
+	HTTPClient   *http.Client
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID provider discovered from its issuer url.
+type Provider struct {
+	config   Config
+	endpoint discovery
+	keys     *keySet
+	now      func() time.Time
+}
+
+// Discover fetches the provider configuration from the well-known discovery
+// document of cfg.Issuer.
+func Discover(ctx context.Context, cfg Config) (*Provider, error) {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if cfg.JWKSCacheTTL == 0 {
+		cfg.JWKSCacheTTL = time.Hour
+	}
+
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	wellKnown := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+
+	var doc discovery
+
+	err := getJSON(ctx, cfg.HTTPClient, wellKnown, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+
+	if doc.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("oidc: discovery: issuer %q does not match the configured issuer %q", doc.Issuer, cfg.Issuer)
+	}
+
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery: document is missing required endpoints")
+	}
+
+	p := &Provider{
+		config:   cfg,
+		endpoint: doc,
+		now:      time.Now,
+	}
+
+	p.keys = newKeySet(cfg.HTTPClient, doc.JWKSURI, cfg.JWKSCacheTTL, p.now)
+
+	return p, nil
+}
+
+func (p *Provider) Issuer() string {
+	return p.config.Issuer
+}
+
+// AuthCodeURL returns the url of the provider login page for the code flow
+// with PKCE.
+func (p *Provider) AuthCodeURL(state, nonce, codeChallenge string) string {
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.endpoint.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return p.endpoint.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// Exchange redeems an authorization code at the token endpoint and returns
+// the verified id token.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*IDToken, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	res, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token request: %w", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token request: %w", err)
+	}
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	err = json.Unmarshal(body, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: token request failed with status %d: %s %s", res.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+
+	if tokens.IDToken == "" {
+		return nil, errors.New("oidc: token response does not contain an id_token")
+	}
+
+	return p.Verify(ctx, tokens.IDToken, nonce)
+}
+
+// NewPKCE returns a random code verifier and its S256 code challenge.
+func NewPKCE() (verifier, challenge string, err error) {
+	verifier, err = RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, encoding.EncodeToString(sum[:]), nil
+}
+
+// RandomString returns n random bytes encoded as url safe base64, it is used
+// for state, nonce and code verifier values.
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", url, res.StatusCode)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(dst)
+}
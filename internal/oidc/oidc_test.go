@@ -0,0 +1,392 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIdP is an in-process OpenID provider that supports discovery, a JWKS
+// endpoint and the code flow with PKCE.
+type fakeIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu        sync.Mutex
+	key       *rsa.PrivateKey
+	kid       string
+	codes     map[string]fakeAuthorization
+	jwksCalls int
+
+	clientID     string
+	clientSecret string
+
+	// claims overrides merged into every id token
+	claims map[string]any
+}
+
+type fakeAuthorization struct {
+	nonce     string
+	challenge string
+	subject   string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+
+	idp := &fakeIdP{
+		t:            t,
+		codes:        make(map[string]fakeAuthorization),
+		clientID:     "greenlight",
+		clientSecret: "s3cret",
+		claims:       map[string]any{},
+	}
+
+	idp.rotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *fakeIdP) rotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	idp.key = key
+	idp.kid = randomKID(idp.t)
+}
+
+func randomKID(t *testing.T) string {
+	kid, err := RandomString(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kid
+}
+
+// authorize stands in for the login page, it returns the code the provider
+// would append to the redirect uri.
+func (idp *fakeIdP) authorize(authURL, subject string) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != idp.clientID {
+		idp.t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	code := randomKID(idp.t)
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	idp.codes[code] = fakeAuthorization{
+		nonce:     query.Get("nonce"),
+		challenge: query.Get("code_challenge"),
+		subject:   subject,
+	}
+
+	return code
+}
+
+func (idp *fakeIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.server.URL,
+		"authorization_endpoint": idp.server.URL + "/authorize",
+		"token_endpoint":         idp.server.URL + "/token",
+		"jwks_uri":               idp.server.URL + "/jwks",
+	})
+}
+
+func (idp *fakeIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	idp.jwksCalls++
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   encoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != idp.clientID || secret != idp.clientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	r.ParseForm()
+
+	idp.mu.Lock()
+	auth, found := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !found || encoding.EncodeToString(sum[:]) != auth.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := map[string]any{
+		"iss":            idp.server.URL,
+		"sub":            auth.subject,
+		"aud":            idp.clientID,
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          auth.nonce,
+		"email":          auth.subject + "@example.com",
+		"email_verified": true,
+		"name":           "Test User",
+	}
+
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "unused",
+		"token_type":   "Bearer",
+		"id_token":     idp.sign(claims),
+	})
+}
+
+func (idp *fakeIdP) sign(claims map[string]any) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": idp.kid})
+	payload, _ := json.Marshal(claims)
+
+	signingInput := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature)
+}
+
+func (idp *fakeIdP) provider(t *testing.T) *Provider {
+	t.Helper()
+
+	p, err := Discover(context.Background(), Config{
+		Issuer:       idp.server.URL,
+		ClientID:     idp.clientID,
+		ClientSecret: idp.clientSecret,
+		RedirectURL:  "https://greenlight.test/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// login runs the whole code flow and returns the result of the exchange.
+func login(t *testing.T, idp *fakeIdP, p *Provider, subject string) (*IDToken, error) {
+	t.Helper()
+
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce, _ := RandomString(16)
+	state, _ := RandomString(16)
+
+	code := idp.authorize(p.AuthCodeURL(state, nonce, challenge), subject)
+
+	return p.Exchange(context.Background(), code, verifier, nonce)
+}
+
+func TestCodeFlow(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider(t)
+
+	token, err := login(t, idp, p, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.Subject != "alice" || token.Email != "alice@example.com" || !token.EmailVerified {
+		t.Errorf("unexpected id token %+v", token)
+	}
+
+	if token.Issuer != idp.server.URL {
+		t.Errorf("got issuer %q; want %q", token.Issuer, idp.server.URL)
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	idp := newFakeIdP(t)
+
+	_, err := Discover(context.Background(), Config{Issuer: idp.server.URL + "/"})
+	if err == nil {
+		t.Fatal("expected an error for a mismatched issuer")
+	}
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider(t)
+
+	_, challenge, _ := NewPKCE()
+	code := idp.authorize(p.AuthCodeURL("state", "nonce", challenge), "alice")
+
+	otherVerifier, _, _ := NewPKCE()
+
+	_, err := p.Exchange(context.Background(), code, otherVerifier, "nonce")
+	if err == nil {
+		t.Fatal("expected the exchange to fail with the wrong code verifier")
+	}
+}
+
+func TestIDTokenValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   error
+	}{
+		{"wrong audience", map[string]any{"aud": "someone-else"}, ErrInvalidIDToken},
+		{"multiple audiences without azp", map[string]any{"aud": []string{"greenlight", "other"}}, ErrInvalidIDToken},
+		{"multiple audiences with azp", map[string]any{"aud": []string{"greenlight", "other"}, "azp": "greenlight"}, nil},
+		{"wrong issuer", map[string]any{"iss": "https://evil.test"}, ErrInvalidIDToken},
+		{"expired", map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}, ErrExpiredIDToken},
+		{"issued in the future", map[string]any{"iat": time.Now().Add(time.Hour).Unix()}, ErrInvalidIDToken},
+		{"wrong nonce", map[string]any{"nonce": "replayed"}, ErrInvalidIDToken},
+		{"email verified as string", map[string]any{"email_verified": "true"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newFakeIdP(t)
+			idp.claims = tt.claims
+			p := idp.provider(t)
+
+			token, err := login(t, idp, p, "alice")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v; want %v", err, tt.want)
+			}
+
+			if tt.want == nil && !token.EmailVerified {
+				t.Errorf("expected email to be verified")
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsTamperedToken(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider(t)
+
+	raw := idp.sign(map[string]any{
+		"iss": idp.server.URL,
+		"sub": "alice",
+		"aud": idp.clientID,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"iat": time.Now().Unix(),
+	})
+
+	parts := strings.Split(raw, ".")
+	payload, _ := json.Marshal(map[string]any{
+		"iss": idp.server.URL,
+		"sub": "admin",
+		"aud": idp.clientID,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"iat": time.Now().Unix(),
+	})
+
+	tampered := parts[0] + "." + encoding.EncodeToString(payload) + "." + parts[2]
+
+	_, err := p.Verify(context.Background(), tampered, "")
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("got error %v; want %v", err, ErrInvalidIDToken)
+	}
+
+	unsigned := encoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+
+	_, err = p.Verify(context.Background(), unsigned, "")
+	if err == nil {
+		t.Fatal("expected alg none to be rejected")
+	}
+}
+
+func TestJWKSCache(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider(t)
+
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	p.keys.now = p.now
+
+	for range 3 {
+		_, err := login(t, idp, p, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if idp.jwksCalls != 1 {
+		t.Errorf("got %d jwks fetches; want 1", idp.jwksCalls)
+	}
+
+	// a token signed with a key we have not seen yet triggers a refetch, but
+	// not before the minimum refetch interval passed
+	idp.rotateKey()
+
+	_, err := login(t, idp, p, "alice")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got error %v; want %v", err, ErrUnknownKey)
+	}
+
+	now = now.Add(minRefetchInterval + time.Second)
+
+	_, err = login(t, idp, p, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if idp.jwksCalls != 2 {
+		t.Errorf("got %d jwks fetches; want 2", idp.jwksCalls)
+	}
+}
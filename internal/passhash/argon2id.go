@@ -0,0 +1,131 @@
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2idMaxLength is the longest password in bytes accepted for argon2id
+// hashes. Argon2id has no limit of its own, this one keeps long passphrases
+// usable while bounding the work per login.
+const Argon2idMaxLength = 256
+
+// Argon2id hashes passwords with argon2id and encodes them in the PHC string
+// format: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type Argon2id struct {
+	Memory     uint32 // in KiB
+	Time       uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+func DefaultArgon2id() Argon2id {
+	return Argon2id{
+		Memory:     64 * 1024,
+		Time:       3,
+		Threads:    2,
+		SaltLength: 16,
+		KeyLength:  32,
+	}
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func (a Argon2id) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a Argon2id) Hash(plainText string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(plainText), salt, a.Time, a.Memory, a.Threads, a.KeyLength)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		a.Memory,
+		a.Time,
+		a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return encoded, nil
+}
+
+func (a Argon2id) Verify(plainText, encoded string) (bool, error) {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(plainText), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+func (a Argon2id) NeedsRehash(encoded string) bool {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.memory != a.Memory ||
+		params.time != a.Time ||
+		params.threads != a.Threads ||
+		uint32(len(params.salt)) != a.SaltLength ||
+		uint32(len(params.key)) != a.KeyLength
+}
+
+func decodeArgon2id(encoded string) (*argon2Params, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrInvalidHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return nil, ErrInvalidHash
+	}
+
+	if version != argon2.Version {
+		return nil, fmt.Errorf("passhash: unsupported argon2 version %d", version)
+	}
+
+	params := &argon2Params{}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return nil, ErrInvalidHash
+	}
+
+	params.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, ErrInvalidHash
+	}
+
+	params.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(params.key) == 0 {
+		return nil, ErrInvalidHash
+	}
+
+	return params, nil
+}
@@ -0,0 +1,55 @@
+package passhash
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BcryptMaxLength is the longest password in bytes bcrypt accepts.
+const BcryptMaxLength = 72
+
+// Bcrypt verifies and produces bcrypt hashes in their modular crypt format
+// ($2a$, $2b$ or $2y$), the format greenlight stored before argon2id.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func (b Bcrypt) Hash(plainText string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plainText), b.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (b Bcrypt) Verify(plainText, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(plainText))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (b Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return true
+	}
+
+	return cost != b.Cost
+}
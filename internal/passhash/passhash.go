@@ -0,0 +1,76 @@
+package passhash
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidHash      = errors.New("passhash: invalid encoded hash")
+	ErrUnknownAlgorithm = errors.New("passhash: unknown hash algorithm")
+)
+
+// Algorithm is a password hashing scheme. Encoded hashes carry the algorithm
+// identifier and its parameters so they can be verified after the
+// configuration changes.
+type Algorithm interface {
+	// Identifies reports whether encoded was produced by this algorithm.
+	Identifies(encoded string) bool
+	Hash(plainText string) (string, error)
+	Verify(plainText, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded was produced with parameters that
+	// differ from the current ones.
+	NeedsRehash(encoded string) bool
+}
+
+// Hasher hashes new passwords with its default algorithm and verifies hashes
+// of the default and every legacy algorithm.
+type Hasher struct {
+	def        Algorithm
+	algorithms []Algorithm
+}
+
+func New(def Algorithm, legacy ...Algorithm) *Hasher {
+	return &Hasher{
+		def:        def,
+		algorithms: append([]Algorithm{def}, legacy...),
+	}
+}
+
+func (h *Hasher) Hash(plainText string) (string, error) {
+	return h.def.Hash(plainText)
+}
+
+func (h *Hasher) Verify(plainText, encoded string) (bool, error) {
+	algorithm, err := h.algorithmFor(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	return algorithm.Verify(plainText, encoded)
+}
+
+// NeedsRehash reports whether encoded should be replaced by a fresh hash of
+// the default algorithm, either because it uses another algorithm or
+// because its parameters are out of date.
+func (h *Hasher) NeedsRehash(encoded string) bool {
+	if !h.def.Identifies(encoded) {
+		return true
+	}
+
+	return h.def.NeedsRehash(encoded)
+}
+
+func (h *Hasher) algorithmFor(encoded string) (Algorithm, error) {
+	if !strings.HasPrefix(encoded, "$") {
+		return nil, ErrInvalidHash
+	}
+
+	for _, algorithm := range h.algorithms {
+		if algorithm.Identifies(encoded) {
+			return algorithm, nil
+		}
+	}
+
+	return nil, ErrUnknownAlgorithm
+}
@@ -0,0 +1,184 @@
+package passhash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testArgon2id keeps the tests fast, the parameters are not fit for
+// production.
+func testArgon2id() Argon2id {
+	return Argon2id{Memory: 64, Time: 1, Threads: 1, SaltLength: 16, KeyLength: 32}
+}
+
+func TestArgon2idEncodeParseRoundTrip(t *testing.T) {
+	a := testArgon2id()
+
+	encoded, err := a.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") || !a.Identifies(encoded) {
+		t.Fatalf("unexpected encoding %q", encoded)
+	}
+
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if params.memory != a.Memory || params.time != a.Time || params.threads != a.Threads ||
+		uint32(len(params.salt)) != a.SaltLength || uint32(len(params.key)) != a.KeyLength {
+		t.Errorf("decoded params %+v do not match %+v", params, a)
+	}
+
+	for password, want := range map[string]bool{"pa55word": true, "pa55worD": false, "": false} {
+		ok, err := a.Verify(password, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != want {
+			t.Errorf("verify %q: got %v, want %v", password, ok, want)
+		}
+	}
+}
+
+func TestArgon2idRejectsMalformedHashes(t *testing.T) {
+	a := testArgon2id()
+
+	for _, encoded := range []string{
+		"",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$not base64$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+	} {
+		_, err := a.Verify("pa55word", encoded)
+		if !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("%q: got %v, want ErrInvalidHash", encoded, err)
+		}
+	}
+
+	_, err := a.Verify("pa55word", "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5")
+	if err == nil {
+		t.Error("expected an error for an unsupported argon2 version")
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	a := testArgon2id()
+
+	encoded, err := a.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.NeedsRehash(encoded) {
+		t.Error("hash with the current parameters needs a rehash")
+	}
+
+	changes := map[string]func(*Argon2id){
+		"memory":      func(a *Argon2id) { a.Memory = 128 },
+		"time":        func(a *Argon2id) { a.Time = 2 },
+		"threads":     func(a *Argon2id) { a.Threads = 2 },
+		"salt length": func(a *Argon2id) { a.SaltLength = 32 },
+		"key length":  func(a *Argon2id) { a.KeyLength = 64 },
+	}
+
+	for name, change := range changes {
+		changed := a
+		change(&changed)
+
+		if !changed.NeedsRehash(encoded) {
+			t.Errorf("changed %s does not need a rehash", name)
+		}
+	}
+
+	if !a.NeedsRehash("garbage") {
+		t.Error("malformed hash does not need a rehash")
+	}
+}
+
+func TestBcryptNeedsRehash(t *testing.T) {
+	b := Bcrypt{Cost: 4}
+
+	encoded, err := b.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.NeedsRehash(encoded) {
+		t.Error("hash with the current cost needs a rehash")
+	}
+
+	if !(Bcrypt{Cost: 5}).NeedsRehash(encoded) {
+		t.Error("hash with an old cost does not need a rehash")
+	}
+}
+
+func TestHasherVerifiesEveryAlgorithm(t *testing.T) {
+	argon2id := testArgon2id()
+	bcryptHasher := Bcrypt{Cost: 4}
+
+	argon2Hash, err := argon2id.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bcryptHash, err := bcryptHasher.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(argon2id, bcryptHasher)
+
+	for _, encoded := range []string{argon2Hash, bcryptHash} {
+		ok, err := h.Verify("pa55word", encoded)
+		if err != nil || !ok {
+			t.Errorf("%q: got %v (%v), want a match", encoded, ok, err)
+		}
+
+		ok, err = h.Verify("wrong", encoded)
+		if err != nil || ok {
+			t.Errorf("%q: wrong password got %v (%v), want no match", encoded, ok, err)
+		}
+	}
+
+	if h.NeedsRehash(argon2Hash) {
+		t.Error("hash of the default algorithm needs a rehash")
+	}
+
+	if !h.NeedsRehash(bcryptHash) {
+		t.Error("hash of a legacy algorithm does not need a rehash")
+	}
+
+	// the other way around, after switching the default back to bcrypt
+	h = New(bcryptHasher, argon2id)
+
+	ok, err := h.Verify("pa55word", argon2Hash)
+	if err != nil || !ok {
+		t.Errorf("argon2id hash with bcrypt default: got %v (%v), want a match", ok, err)
+	}
+
+	if !h.NeedsRehash(argon2Hash) {
+		t.Error("argon2id hash does not need a rehash with bcrypt as default")
+	}
+}
+
+func TestHasherRejectsUnknownHashes(t *testing.T) {
+	h := New(testArgon2id())
+
+	_, err := h.Verify("pa55word", "$2a$04$abcdefghijklmnopqrstuu")
+	if !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("got %v, want ErrUnknownAlgorithm", err)
+	}
+
+	_, err = h.Verify("pa55word", "plain text")
+	if !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("got %v, want ErrInvalidHash", err)
+	}
+}
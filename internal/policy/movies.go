@@ -0,0 +1,30 @@
+package policy
+
+import (
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+)
+
+const (
+	MoviesWrite    = "movies:write"
+	MoviesWriteOwn = "movies:write:own"
+)
+
+// MovieWriters lists the permission codes that allow a user to create movies
+// and to reach the update and delete handlers, where CanModifyMovie makes the
+// final decision for the loaded movie.
+var MovieWriters = []string{MoviesWrite, MoviesWriteOwn}
+
+// CanModifyMovie reports whether user may update or delete movie.
+// movies:write grants access to every movie while movies:write:own only
+// grants access to the movies the user created.
+func CanModifyMovie(user *data.User, permissions data.Permissions, movie *data.Movie) bool {
+	if permissions.Include(MoviesWrite) {
+		return true
+	}
+
+	if !permissions.Include(MoviesWriteOwn) {
+		return false
+	}
+
+	return movie.CreatedBy != nil && *movie.CreatedBy == user.ID
+}
@@ -0,0 +1,74 @@
+package pwpolicy
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter is a compact probabilistic set. Test never reports a false
+// negative and reports false positives at roughly the rate it was sized for,
+// which is acceptable for rejecting breached passwords.
+type BloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes uint64
+}
+
+// NewBloomFilter sizes a filter for n entries with the given false positive
+// rate.
+func NewBloomFilter(n int, falsePositiveRate float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+
+	size := uint64(m)
+	return &BloomFilter{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: uint64(k),
+	}
+}
+
+func (b *BloomFilter) Add(value string) {
+	h1, h2 := b.baseHashes(value)
+
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.size
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *BloomFilter) Test(value string) bool {
+	h1, h2 := b.baseHashes(value)
+
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.size
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// baseHashes derives the two hashes used for double hashing
+// (Kirsch-Mitzenmacher), every probe is h1 + i*h2.
+func (b *BloomFilter) baseHashes(value string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	h1 := h.Sum64()
+
+	h = fnv.New64()
+	h.Write([]byte(value))
+	h2 := h.Sum64() | 1
+
+	return h1, h2
+}
+
+// SizeBytes returns the memory used by the bit set.
+func (b *BloomFilter) SizeBytes() int {
+	return len(b.bits) * 8
+}
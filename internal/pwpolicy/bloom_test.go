@@ -0,0 +1,52 @@
+package pwpolicy
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestBloomFilterHasNoFalseNegatives(t *testing.T) {
+	filter := NewBloomFilter(1000, 0.001)
+
+	for i := range 1000 {
+		filter.Add("added-" + strconv.Itoa(i))
+	}
+
+	for i := range 1000 {
+		if !filter.Test("added-" + strconv.Itoa(i)) {
+			t.Fatalf("added-%d not found", i)
+		}
+	}
+}
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	filter := NewBloomFilter(1000, 0.001)
+
+	for i := range 1000 {
+		filter.Add("added-" + strconv.Itoa(i))
+	}
+
+	falsePositives := 0
+	for i := range 100000 {
+		if filter.Test("missing-" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+
+	// sized for 0.1%, allow some slack for the hash functions
+	if falsePositives > 300 {
+		t.Errorf("got %d false positives in 100000 tests, want about 100", falsePositives)
+	}
+}
+
+func TestBloomFilterEmpty(t *testing.T) {
+	filter := NewBloomFilter(0, 0.001)
+
+	if filter.Test("anything") {
+		t.Error("empty filter reported a match")
+	}
+
+	if filter.SizeBytes() == 0 {
+		t.Error("filter has no bits")
+	}
+}
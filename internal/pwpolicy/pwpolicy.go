@@ -0,0 +1,192 @@
+package pwpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+// Policy holds the rules new passwords must follow. Breached may be nil when
+// no breached passwords list is configured.
+type Policy struct {
+	MinLength  int
+	MaxLength  int
+	MinEntropy float64
+	Breached   *BloomFilter
+}
+
+// Validate adds a validator error for the first rule password breaks. name
+// and email belong to the account and must not be part of the password.
+func (p *Policy) Validate(v *validator.Validator, password, name, email string) {
+	v.Check(password != "", "password", "must be provided")
+	v.Check(len(password) >= p.MinLength, "password", fmt.Sprintf("must not be less than %d bytes long", p.MinLength))
+	v.Check(len(password) <= p.MaxLength, "password", fmt.Sprintf("must not be more than %d bytes long", p.MaxLength))
+
+	lower := strings.ToLower(password)
+
+	for _, part := range strings.Fields(strings.ToLower(name)) {
+		if len(part) >= 3 {
+			v.Check(!strings.Contains(lower, part), "password", "must not contain your name")
+		}
+	}
+
+	if local, _, found := strings.Cut(strings.ToLower(email), "@"); found {
+		v.Check(!strings.Contains(lower, strings.ToLower(email)), "password", "must not contain your email address")
+		if len(local) >= 3 {
+			v.Check(!strings.Contains(lower, local), "password", "must not contain your email address")
+		}
+	}
+
+	if p.MinEntropy > 0 {
+		score := Entropy(password)
+		v.Check(score >= p.MinEntropy, "password", fmt.Sprintf("is too easy to guess (strength %.0f of %.0f required), use a longer password or mix in other characters", score, p.MinEntropy))
+	}
+
+	if p.Breached != nil {
+		v.Check(!p.IsBreached(password), "password", "appears in a list of breached passwords, please choose a different one")
+	}
+}
+
+// IsBreached checks password against the breached list. The list may contain
+// plain passwords or upper case SHA-1 hex digests as published by Have I Been
+// Pwned, so both forms are tested.
+func (p *Policy) IsBreached(password string) bool {
+	if p.Breached == nil {
+		return false
+	}
+
+	if p.Breached.Test(password) || p.Breached.Test(strings.ToLower(password)) {
+		return true
+	}
+
+	sum := sha1.Sum([]byte(password))
+	return p.Breached.Test(strings.ToUpper(hex.EncodeToString(sum[:])))
+}
+
+// Entropy estimates the strength of password in bits. It multiplies the size
+// of the character pool in use by an effective length in which repeated and
+// sequential characters (aaaa, 1234, abcd) only count for a fraction.
+func Entropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	if other {
+		pool += 100
+	}
+
+	if pool == 0 {
+		return 0
+	}
+
+	length := 0.0
+	var prev rune
+	for i, r := range password {
+		switch {
+		case i == 0:
+			length++
+		case r == prev, r == prev+1, r == prev-1:
+			length += 0.25
+		default:
+			length++
+		}
+		prev = r
+	}
+
+	return length * math.Log2(float64(pool))
+}
+
+// LoadBreachedList reads a file with one password or SHA-1 digest per line
+// (an optional ":count" suffix is ignored) into a bloom filter with a 0.1%
+// false positive rate.
+func LoadBreachedList(path string) (*BloomFilter, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			count++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	filter := NewBloomFilter(count, 0.001)
+
+	scanner = bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if entry, _, found := strings.Cut(line, ":"); found && isSHA1Hex(entry) {
+			line = entry
+		}
+
+		if isSHA1Hex(line) {
+			line = strings.ToUpper(line)
+		}
+
+		filter.Add(line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return filter, count, nil
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
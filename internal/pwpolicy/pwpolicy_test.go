@@ -0,0 +1,137 @@
+package pwpolicy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+func TestEntropy(t *testing.T) {
+	tests := []struct {
+		password string
+		want     float64
+	}{
+		{"", 0},
+		{"a", math.Log2(26)},
+		{"ab", 1.25 * math.Log2(26)},
+		{"aaaa", 1.75 * math.Log2(26)},
+		{"dcba", 1.75 * math.Log2(26)},
+		{"aZ", 2 * math.Log2(52)},
+		{"a1!", 3 * math.Log2(69)},
+		{"é", math.Log2(100)},
+	}
+
+	for _, tt := range tests {
+		if got := Entropy(tt.password); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Entropy(%q): got %f, want %f", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestEntropyOrdersPasswords(t *testing.T) {
+	weaker := []string{"aaaaaaaaaaaa", "abcdefghijkl", "123456789012"}
+	stronger := "kq7#Vm2!xRp9"
+
+	for _, password := range weaker {
+		if Entropy(password) >= Entropy(stronger) {
+			t.Errorf("%q scored at least as strong as %q", password, stronger)
+		}
+	}
+}
+
+func writeList(t *testing.T, lines ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLoadBreachedList(t *testing.T) {
+	path := writeList(t,
+		"password123",
+		"",
+		"   ",
+		strings.ToLower(sha1Hex("correcthorse"))+":3730471",
+		strings.ToUpper(sha1Hex("batterystaple")),
+	)
+
+	filter, count, err := LoadBreachedList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 3 {
+		t.Errorf("got %d entries, want 3", count)
+	}
+
+	p := &Policy{Breached: filter}
+
+	for _, password := range []string{"password123", "PASSWORD123", "correcthorse", "batterystaple"} {
+		if !p.IsBreached(password) {
+			t.Errorf("%q not reported as breached", password)
+		}
+	}
+
+	if p.IsBreached("kq7#Vm2!xRp9") {
+		t.Error("password not on the list reported as breached")
+	}
+}
+
+func TestLoadBreachedListMissingFile(t *testing.T) {
+	_, _, err := LoadBreachedList(filepath.Join(t.TempDir(), "missing.txt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("got %v, want a not exist error", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	filter, _, err := LoadBreachedList(writeList(t, "Summer2024!!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Policy{MinLength: 10, MaxLength: 72, MinEntropy: 40, Breached: filter}
+
+	tests := []struct {
+		name     string
+		password string
+		valid    bool
+	}{
+		{"strong", "kq7#Vm2!xRp9", true},
+		{"empty", "", false},
+		{"too short", "kq7#Vm2!", false},
+		{"too long", strings.Repeat("kq7#Vm2!", 10), false},
+		{"contains name", "kq7#alice!xRp9", false},
+		{"contains email", "kq7#alice.smith!", false},
+		{"too easy to guess", "aaaaaaaaaaaaaaaa", false},
+		{"breached", "Summer2024!!", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			p.Validate(v, tt.password, "Alice Smith", "alice.smith@example.com")
+
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %v, want %v (errors %v)", v.Valid(), tt.valid, v.Errors)
+			}
+		})
+	}
+}
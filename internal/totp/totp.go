@@ -0,0 +1,124 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Parameters follow the defaults of RFC 6238, which every authenticator app
+// supports: HMAC-SHA1, 6 digits and a 30 seconds period.
+const (
+	Digits = 6
+	Period = 30
+
+	// modulo is 10^Digits
+	modulo = 1_000_000
+)
+
+var ErrInvalidSecret = errors.New("invalid totp secret")
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random 160 bits secret, base32 encoded as
+// expected by authenticator apps.
+func GenerateSecret() (string, error) {
+	randomBytes := make([]byte, 20)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(randomBytes), nil
+}
+
+// ProvisioningURI builds the otpauth:// URI shown to the user as a QR code.
+func ProvisioningURI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	qs := url.Values{}
+	qs.Set("secret", secret)
+	qs.Set("issuer", issuer)
+	qs.Set("algorithm", "SHA1")
+	qs.Set("digits", fmt.Sprint(Digits))
+	qs.Set("period", fmt.Sprint(Period))
+
+	return "otpauth://totp/" + label + "?" + qs.Encode()
+}
+
+// Step returns the time step counter for t.
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code of secret for the time step containing t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return codeAt(key, Step(t)), nil
+}
+
+// Validate checks code against the steps around t, allowing skew steps of
+// clock drift in both directions. Steps up to lastUsed are skipped, so a code
+// can not be replayed. The matching step is returned for the caller to store
+// as the new lastUsed.
+func Validate(secret, code string, t time.Time, skew int, lastUsed int64) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	current := Step(t)
+	for i := -skew; i <= skew; i++ {
+		step := current + int64(i)
+		if step <= lastUsed {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(codeAt(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+
+	return key, nil
+}
+
+func codeAt(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%modulo)
+}
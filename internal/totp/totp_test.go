@@ -0,0 +1,148 @@
+package totp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of RFC 6238 Appendix B, "12345678901234567890",
+// base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238Vectors(t *testing.T) {
+	// the RFC lists 8 digit codes, 6 digit codes are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tt.want {
+			t.Errorf("code at %d: got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCodeInvalidSecret(t *testing.T) {
+	for _, secret := range []string{"", "not base32!"} {
+		_, err := Code(secret, time.Now())
+		if !errors.Is(err, ErrInvalidSecret) {
+			t.Errorf("secret %q: got %v, want ErrInvalidSecret", secret, err)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	code, err := Code(rfcSecret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		at    time.Time
+		skew  int
+		valid bool
+	}{
+		{"same step", now, 0, true},
+		{"one step later within skew", now.Add(Period * time.Second), 1, true},
+		{"one step earlier within skew", now.Add(-Period * time.Second), 1, true},
+		{"one step later without skew", now.Add(Period * time.Second), 0, false},
+		{"two steps later", now.Add(2 * Period * time.Second), 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, code, tt.at, tt.skew, 0)
+			if ok != tt.valid {
+				t.Fatalf("got valid %v, want %v", ok, tt.valid)
+			}
+
+			if ok && step != Step(now) {
+				t.Errorf("got step %d, want %d", step, Step(now))
+			}
+		})
+	}
+}
+
+func TestValidateRejectsReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+
+	code, err := Code(rfcSecret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, ok := Validate(rfcSecret, code, now, 1, 0)
+	if !ok {
+		t.Fatal("expected the code to be valid")
+	}
+
+	// the same code again, also from within the skew window of the next step
+	for _, at := range []time.Time{now, now.Add(Period * time.Second)} {
+		if _, ok := Validate(rfcSecret, code, at, 1, step); ok {
+			t.Errorf("replayed code accepted at %v", at)
+		}
+	}
+
+	// an older code is refused once a newer one was used
+	older, err := Code(rfcSecret, now.Add(-Period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := Validate(rfcSecret, older, now, 1, step); ok {
+		t.Error("code of an earlier step accepted after a later one was used")
+	}
+
+	next, err := Code(rfcSecret, now.Add(Period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := Validate(rfcSecret, next, now.Add(Period*time.Second), 1, step); !ok {
+		t.Error("code of the next step refused")
+	}
+}
+
+func TestValidateMalformedCode(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	for _, code := range []string{"", "28708", "2870820", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, now, 1, 0); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+}
+
+func TestGenerateSecretAndURI(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Code(secret, time.Now()); err != nil {
+		t.Fatalf("generated secret is not usable: %v", err)
+	}
+
+	uri := ProvisioningURI("Green Light", "alice@example.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Green%20Light:alice@example.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("unexpected provisioning uri %q", uri)
+	}
+}
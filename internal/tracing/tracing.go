@@ -1,35 +1,172 @@
+// Package tracing sets up the OpenTelemetry tracer provider, its exporter
+// and sampler, and the W3C trace context and baggage propagation.
 package tracing
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	otlphttp "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 )
 
-func NewTracingExporter(ctx context.Context) (*otlptrace.Exporter, error) {
-	return otlphttp.New(ctx, otlphttp.WithEndpointURL("http://localhost:4318"))
+const (
+	ExporterOTLPHTTP = "otlp-http"
+	ExporterOTLPGRPC = "otlp-grpc"
+	ExporterStdout   = "stdout"
+	ExporterFile     = "file"
+	ExporterNone     = "none"
+)
+
+var Exporters = []string{ExporterOTLPHTTP, ExporterOTLPGRPC, ExporterStdout, ExporterFile, ExporterNone}
+
+type Config struct {
+	// Exporter is one of Exporters.
+	Exporter string
+	// Endpoint is the url of the OTLP collector, the exporter default (or
+	// OTEL_EXPORTER_OTLP_ENDPOINT) is used when empty.
+	Endpoint string
+	// File is the file spans are appended to by the file exporter.
+	File string
+
+	// SampleRatio is the share of new traces that are sampled.
+	SampleRatio float64
+	// ParentBased follows the sampling decision of the caller for requests
+	// that are part of a trace already.
+	ParentBased bool
+
+	ServiceName    string
+	ServiceVersion string
+	Environment    string
 }
 
-func NewTracingProvider(exp sdktrace.SpanExporter, service string) *sdktrace.TracerProvider {
+// Provider is a tracer provider that also releases the file the file
+// exporter writes to on shutdown.
+type Provider struct {
+	*sdktrace.TracerProvider
+	closer io.Closer
+}
+
+// Shutdown flushes the spans that were not exported yet and stops the
+// provider.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	err := p.TracerProvider.Shutdown(ctx)
+
+	if p.closer != nil {
+		err = errors.Join(err, p.closer.Close())
+	}
+
+	return err
+}
+
+// NewProvider creates a tracer provider for cfg. Spans are still created and
+// carry trace ids, for log correlation, when the exporter is none.
+func NewProvider(ctx context.Context, cfg Config) (*Provider, error) {
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("sample ratio %v must be between 0 and 1", cfg.SampleRatio)
+	}
 
 	res, err := resource.Merge(
 		resource.Default(),
 		resource.NewWithAttributes(
 			semconv.SchemaURL,
-			semconv.ServiceName(service),
+			semconv.ServiceName(cfg.ServiceName),
+			semconv.ServiceVersion(cfg.ServiceVersion),
+			semconv.DeploymentEnvironmentName(cfg.Environment),
 		),
 	)
-
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	var sampler sdktrace.Sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	if cfg.ParentBased {
+		sampler = sdktrace.ParentBased(sampler)
 	}
 
-	return sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
+	opts := []sdktrace.TracerProviderOption{
 		sdktrace.WithResource(res),
-	)
+		sdktrace.WithSampler(sampler),
+	}
+
+	p := &Provider{}
+
+	exp, err := newExporter(ctx, cfg, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if exp != nil {
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+
+	p.TracerProvider = sdktrace.NewTracerProvider(opts...)
+
+	return p, nil
+}
+
+func newExporter(ctx context.Context, cfg Config, p *Provider) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case ExporterOTLPHTTP:
+		var opts []otlphttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlphttp.WithEndpointURL(cfg.Endpoint))
+		}
+
+		return otlphttp.New(ctx, opts...)
+
+	case ExporterOTLPGRPC:
+		var opts []otlptracegrpc.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(cfg.Endpoint))
+		}
+
+		return otlptracegrpc.New(ctx, opts...)
+
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+
+	case ExporterFile:
+		if cfg.File == "" {
+			return nil, errors.New("the file exporter requires a file")
+		}
+
+		err := os.MkdirAll(filepath.Dir(cfg.File), 0o755)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		p.closer = file
+
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+
+	case ExporterNone:
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+}
+
+// SetPropagation registers the W3C trace context and baggage propagators
+// globally, so incoming traceparent headers continue the caller's trace.
+func SetPropagation() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
 }
@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestFileExporterFlushedOnShutdown(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "traces", "spans.jsonl")
+
+	p, err := NewProvider(context.Background(), Config{
+		Exporter:       ExporterFile,
+		File:           file,
+		SampleRatio:    1,
+		ServiceName:    "greenlight",
+		ServiceVersion: "v1.2.3",
+		Environment:    "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := p.Tracer("test").Start(context.Background(), "flushed span")
+	span.End()
+
+	err = p.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{`"Name":"flushed span"`, `"Value":"v1.2.3"`, `"Value":"test"`} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("exported spans do not contain %s:\n%s", want, content)
+		}
+	}
+}
+
+func TestParentBasedSampling(t *testing.T) {
+	SetPropagation()
+
+	tests := []struct {
+		name        string
+		parentBased bool
+		traceparent string
+		sampled     bool
+	}{
+		{"new trace", true, "", false},
+		{"sampled parent", true, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"sampled parent ignored", false, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewProvider(context.Background(), Config{Exporter: ExporterNone, SampleRatio: 0, ParentBased: tt.parentBased})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Shutdown(context.Background())
+
+			header := http.Header{}
+			if tt.traceparent != "" {
+				header.Set("traceparent", tt.traceparent)
+			}
+
+			ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(header))
+			_, span := p.Tracer("test").Start(ctx, "request")
+			defer span.End()
+
+			if got := span.SpanContext().IsSampled(); got != tt.sampled {
+				t.Errorf("got sampled %v, want %v", got, tt.sampled)
+			}
+
+			if tt.traceparent != "" && span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Errorf("span did not continue the trace of the caller")
+			}
+		})
+	}
+}
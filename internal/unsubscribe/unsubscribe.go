@@ -0,0 +1,63 @@
+// Package unsubscribe creates and verifies the signed tokens of one-click
+// unsubscribe links. The tokens do not expire, unsubscribe links in old
+// emails keep working.
+package unsubscribe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidToken = errors.New("invalid unsubscribe token")
+
+var encoding = base64.RawURLEncoding
+
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key}
+}
+
+// Token returns the token for the unsubscribe link of userID.
+func (s *Signer) Token(userID int64) string {
+	id := strconv.FormatInt(userID, 10)
+
+	return id + "." + encoding.EncodeToString(s.sign(id))
+}
+
+// Verify returns the user id of a token created by Token.
+func (s *Signer) Verify(token string) (int64, error) {
+	id, signature, found := strings.Cut(token, ".")
+	if !found {
+		return 0, ErrInvalidToken
+	}
+
+	mac, err := encoding.DecodeString(signature)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+
+	if !hmac.Equal(mac, s.sign(id)) {
+		return 0, ErrInvalidToken
+	}
+
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || userID < 1 {
+		return 0, ErrInvalidToken
+	}
+
+	return userID, nil
+}
+
+func (s *Signer) sign(id string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("unsubscribe:" + id))
+
+	return mac.Sum(nil)
+}
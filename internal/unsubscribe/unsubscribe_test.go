@@ -0,0 +1,68 @@
+package unsubscribe
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte(strings.Repeat("k", 32))
+
+func TestTokenRoundTrip(t *testing.T) {
+	s := NewSigner(testKey)
+
+	for _, userID := range []int64{1, 42, 9223372036854775807} {
+		got, err := s.Verify(s.Token(userID))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != userID {
+			t.Errorf("got user id %d, want %d", got, userID)
+		}
+	}
+}
+
+func TestTokenIsStable(t *testing.T) {
+	// links in old emails must keep working with the same key
+	if NewSigner(testKey).Token(42) != NewSigner(testKey).Token(42) {
+		t.Error("tokens of the same user and key differ")
+	}
+}
+
+func TestVerifyRejectsTamperedTokens(t *testing.T) {
+	s := NewSigner(testKey)
+	token := s.Token(42)
+	id, signature, _ := strings.Cut(token, ".")
+
+	// a valid signature of another user must not verify for this one
+	_, otherSignature, _ := strings.Cut(s.Token(43), ".")
+
+	flipped := []byte(signature)
+	flipped[0] ^= 1
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"other user id", "43." + signature},
+		{"swapped signature", id + "." + otherSignature},
+		{"flipped signature", id + "." + string(flipped)},
+		{"other key", NewSigner([]byte(strings.Repeat("x", 32))).Token(42)},
+		{"no signature", id},
+		{"empty signature", id + "."},
+		{"signature not base64", id + ".!!!"},
+		{"zero user id", "0." + encoding.EncodeToString(s.sign("0"))},
+		{"user id not a number", "abc." + encoding.EncodeToString(s.sign("abc"))},
+		{"empty", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Verify(tt.token)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
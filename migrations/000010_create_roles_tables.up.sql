@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    name TEXT UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    built_in BOOL NOT NULL DEFAULT false,
+    version INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id BIGINT NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id BIGINT NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY(role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id BIGINT NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY(user_id, role_id)
+);
+
+INSERT INTO permissions(code)
+VALUES
+    ('roles:admin');
+
+INSERT INTO roles(name, description, built_in)
+VALUES
+    ('viewer', 'can browse the movies catalogue', true),
+    ('editor', 'can browse and edit the movies catalogue', true),
+    ('admin', 'has every permission', true);
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'viewer' AND permissions.code IN ('movies:read'))
+OR (roles.name = 'editor' AND permissions.code IN ('movies:read', 'movies:write'))
+OR roles.name = 'admin';
@@ -0,0 +1,10 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked BOOL NOT NULL DEFAULT false;
+
+INSERT INTO permissions(code)
+VALUES
+    ('users:admin');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'users:admin';
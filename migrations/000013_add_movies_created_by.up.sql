@@ -0,0 +1,16 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by BIGINT REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
+
+INSERT INTO permissions(code)
+VALUES
+    ('movies:write:own');
+
+INSERT INTO roles(name, description, built_in)
+VALUES
+    ('contributor', 'can browse the movies catalogue and edit the movies they added', true);
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'contributor' AND permissions.code IN ('movies:read', 'movies:write:own');
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS users_totp (
+    user_id BIGINT PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    confirmed_at TIMESTAMP(0) WITH TIME ZONE,
+    last_used_step BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+    hash BYTEA PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+    used_at TIMESTAMP(0) WITH TIME ZONE
+);
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_login_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_failed_login_at TIMESTAMP(0) WITH TIME ZONE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP(0) WITH TIME ZONE;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id BIGSERIAL PRIMARY KEY,
+    client_id TEXT UNIQUE NOT NULL,
+    secret_hash BYTEA,
+    user_id BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    redirect_uris TEXT[] NOT NULL DEFAULT '{}',
+    grant_types TEXT[] NOT NULL DEFAULT '{}',
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    version INTEGER NOT NULL DEFAULT 1
+);
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS client_id TEXT REFERENCES oauth_clients (client_id) ON DELETE CASCADE;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS oauth_scopes TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS redirect_uri TEXT NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS code_challenge TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS tokens_client_id_idx ON tokens (client_id);
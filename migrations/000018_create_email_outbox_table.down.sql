@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'emails:admin';
+
+DROP TABLE IF EXISTS email_outbox;
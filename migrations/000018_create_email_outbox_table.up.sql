@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    recipient citext NOT NULL,
+    template TEXT NOT NULL,
+    data JSONB NOT NULL DEFAULT '{}',
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP(0) WITH TIME ZONE,
+    created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP(0) WITH TIME ZONE,
+    version INTEGER NOT NULL DEFAULT 1,
+    CONSTRAINT email_outbox_status_check CHECK (status IN ('pending', 'sending', 'sent', 'dead'))
+);
+
+CREATE INDEX IF NOT EXISTS email_outbox_status_next_attempt_at_idx ON email_outbox (status, next_attempt_at);
+
+INSERT INTO permissions(code)
+VALUES
+    ('emails:admin');
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id BIGINT PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    genres TEXT[] NOT NULL DEFAULT '{}',
+    frequency TEXT NOT NULL DEFAULT 'weekly',
+    opted_out BOOLEAN NOT NULL DEFAULT FALSE,
+    last_digest_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    version INTEGER NOT NULL DEFAULT 1,
+    CONSTRAINT notification_preferences_frequency_check CHECK (frequency IN ('daily', 'weekly'))
+);
+
+CREATE INDEX IF NOT EXISTS notification_preferences_last_digest_at_idx ON notification_preferences (last_digest_at) WHERE NOT opted_out;
+
+CREATE INDEX IF NOT EXISTS movies_created_at_idx ON movies (created_at);
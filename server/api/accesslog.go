@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/julienschmidt/httprouter"
+	"github.com/tomasen/realip"
+)
+
+const (
+	accessLogJSON     = "json"
+	accessLogCombined = "combined"
+	accessLogNone     = "none"
+)
+
+var accessLogFormats = []string{accessLogJSON, accessLogCombined, accessLogNone}
+
+// accessLogger decides which completed requests are logged. JSON entries go
+// through the application logger, combined (Apache) lines are written to out.
+type accessLogger struct {
+	format      string
+	out         io.Writer
+	exclude     map[string]bool
+	sampleAfter int
+	sampleRate  float64
+
+	mu     sync.Mutex
+	second int64
+	seen   int
+}
+
+func newAccessLogger(out io.Writer, format string, exclude []string, sampleAfter int, sampleRate float64) *accessLogger {
+	l := &accessLogger{
+		format:      format,
+		out:         out,
+		exclude:     make(map[string]bool, len(exclude)),
+		sampleAfter: sampleAfter,
+		sampleRate:  sampleRate,
+	}
+
+	for _, path := range exclude {
+		l.exclude[path] = true
+	}
+
+	return l
+}
+
+// sampled reports whether a successful request is logged. The first
+// sampleAfter successful requests of every second are always logged, the
+// following ones with a probability of sampleRate. Failed requests are
+// never sampled.
+func (l *accessLogger) sampled(now time.Time) bool {
+	if l.sampleAfter <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	if sec := now.Unix(); sec != l.second {
+		l.second = sec
+		l.seen = 0
+	}
+	l.seen++
+	seen := l.seen
+	l.mu.Unlock()
+
+	return seen <= l.sampleAfter || rand.Float64() < l.sampleRate
+}
+
+func (l *accessLogger) writeCombined(r *http.Request, start time.Time, m httpsnoop.Metrics, userID int64) {
+	user := "-"
+	if userID != 0 {
+		user = strconv.FormatInt(userID, 10)
+	}
+
+	size := "-"
+	if m.Written > 0 {
+		size = strconv.FormatInt(m.Written, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		realip.FromRequest(r),
+		user,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeLogField(r.Method),
+		escapeLogField(r.URL.EscapedPath()),
+		escapeLogField(r.Proto),
+		m.Code,
+		size,
+		escapeLogField(r.Referer()),
+		escapeLogField(r.UserAgent()),
+	)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	io.WriteString(l.out, line)
+}
+
+// escapeLogField escapes quotes, backslashes and control characters the way
+// Apache does, so client supplied values can not forge log lines.
+func escapeLogField(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// routeRecorder registers routes on an httprouter.Router and records the
+// pattern of the route a request matched in its access record, so entries
+// can be grouped by endpoint.
+type routeRecorder struct {
+	*httprouter.Router
+}
+
+func (rr routeRecorder) Handle(method, path string, handle httprouter.Handle) {
+	rr.Router.Handle(method, path, func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		recordRoute(r, path)
+		handle(w, r, params)
+	})
+}
+
+func (rr routeRecorder) Handler(method, path string, handler http.Handler) {
+	rr.Router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recordRoute(r, path)
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func (rr routeRecorder) GET(path string, handle httprouter.Handle) {
+	rr.Handle(http.MethodGet, path, handle)
+}
+
+func (rr routeRecorder) POST(path string, handle httprouter.Handle) {
+	rr.Handle(http.MethodPost, path, handle)
+}
+
+func (rr routeRecorder) PUT(path string, handle httprouter.Handle) {
+	rr.Handle(http.MethodPut, path, handle)
+}
+
+func (rr routeRecorder) PATCH(path string, handle httprouter.Handle) {
+	rr.Handle(http.MethodPatch, path, handle)
+}
+
+func (rr routeRecorder) DELETE(path string, handle httprouter.Handle) {
+	rr.Handle(http.MethodDelete, path, handle)
+}
+
+func recordRoute(r *http.Request, pattern string) {
+	if rec, ok := r.Context().Value(accessRecordContextKey).(*accessRecord); ok {
+		rec.route = pattern
+	}
+}
+
+// accessLog logs every request once it completed, with the status, response
+// size and latency that are only known at that point. Only the path of the
+// request is logged, query strings may carry tokens.
+func (app *Application) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := app.accessLogger
+		if l == nil || l.format == accessLogNone || l.exclude[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &accessRecord{}
+		r = r.WithContext(context.WithValue(r.Context(), accessRecordContextKey, rec))
+
+		start := time.Now()
+		m := httpsnoop.CaptureMetrics(next, w, r)
+
+		// empty when no route matched
+		route := rec.route
+		if l.exclude[route] {
+			return
+		}
+
+		if m.Code < http.StatusBadRequest && !l.sampled(start) {
+			return
+		}
+
+		if l.format == accessLogCombined {
+			l.writeCombined(r, start, m, rec.userID)
+			return
+		}
+
+		app.logger.InfoContext(r.Context(), "request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"proto", r.Proto,
+			"status", m.Code,
+			"bytes", m.Written,
+			"duration_ms", float64(m.Duration.Microseconds())/1000,
+			"ip", realip.FromRequest(r),
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
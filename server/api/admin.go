@@ -0,0 +1,469 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/jsonlog"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// logAdminAction writes an audit entry for every change made through the
+// admin api, including the acting user.
+func (app *Application) logAdminAction(r *http.Request, action string, targetUserID int64, properties map[string]string) {
+	actor := app.contextGetUser(r)
+
+	entry := map[string]string{
+		"action":         action,
+		"actor_id":       strconv.FormatInt(actor.ID, 10),
+		"target_user_id": strconv.FormatInt(targetUserID, 10),
+		"ip":             realip.FromRequest(r),
+	}
+
+	for k, v := range properties {
+		entry[k] = v
+	}
+
+	app.logger.PrintAuditContext(r.Context(), "admin action", entry)
+}
+
+func (app *Application) readUserIDParam(w http.ResponseWriter, r *http.Request, params httprouter.Params) (*data.User, bool) {
+	id, err := app.readIDParam(params)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (app *Application) adminListUsersHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin list users")
+	defer span.End()
+
+	var input struct {
+		Search string
+		data.Filters
+	}
+
+	span.AddEvent("reading url query string and validating")
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+
+	input.Filters.SortSafelist = []string{"id", "-id", "name", "-name", "email", "-email", "created_at", "-created_at"}
+
+	data.ValidateFilters(v, input.Filters)
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("getting users")
+	users, meta, err := app.models.Users.GetAll(input.Search, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"metadata": meta, "users": users}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) adminShowUserHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin show user")
+	defer span.End()
+
+	span.AddEvent("query user with id")
+	user, ok := app.readUserIDParam(w, r, params)
+	if !ok {
+		return
+	}
+
+	span.AddEvent("query user permissions and roles")
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	direct, err := app.models.Permissions.GetDirectForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{
+		"user":               user,
+		"permissions":        permissions,
+		"direct_permissions": direct,
+		"roles":              roles,
+		"login_failures": map[string]any{
+			"attempts":       user.FailedLoginAttempts,
+			"last_failed_at": user.LastFailedLoginAt,
+			"locked_until":   user.LockedUntil,
+		},
+	}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) adminUpdateUserHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin update user")
+	defer span.End()
+
+	span.AddEvent("query user with id")
+	user, ok := app.readUserIDParam(w, r, params)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Activated *bool `json:"activated"`
+		Locked    *bool `json:"locked"`
+	}
+
+	span.AddEvent("read request body")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Activated != nil || input.Locked != nil, "body", "must contain activated or locked")
+
+	actor := app.contextGetUser(r)
+	if actor.ID == user.ID {
+		v.Check(input.Activated == nil || *input.Activated, "activated", "you can not deactivate your own account")
+		v.Check(input.Locked == nil || !*input.Locked, "locked", "you can not lock your own account")
+	}
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// locking or deactivating an account takes its permissions away, which
+	// is only allowed for permissions the actor could grant
+	span.AddEvent("query user permissions")
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ok, err = app.canGrant(r, permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.userNotManageableResponse(w, r)
+		return
+	}
+
+	changes := map[string]string{}
+
+	if input.Activated != nil && *input.Activated != user.Activated {
+		user.Activated = *input.Activated
+		changes["activated"] = strconv.FormatBool(user.Activated)
+	}
+
+	if input.Locked != nil && *input.Locked != user.Locked {
+		user.Locked = *input.Locked
+		changes["locked"] = strconv.FormatBool(user.Locked)
+	}
+
+	span.AddEvent("update user in database")
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// unlocking also lifts a temporary lockout caused by failed logins
+	if input.Locked != nil && !*input.Locked && user.FailedLoginAttempts > 0 {
+		span.AddEvent("resetting failed logins")
+		err = app.models.Users.ResetLoginFailures(user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		changes["login_failures_reset"] = "true"
+	}
+
+	// a locked or deactivated account loses every session and refresh token
+	// straight away
+	if user.Locked || !user.Activated {
+		span.AddEvent("revoking user tokens")
+		for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+			err = app.models.Tokens.DeleteAllForUser(user.ID, scope)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	if len(changes) > 0 {
+		app.logAdminAction(r, "update_user", user.ID, changes)
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) adminGrantPermissionsHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin grant permissions")
+	defer span.End()
+
+	span.AddEvent("query user with id")
+	user, ok := app.readUserIDParam(w, r, params)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Codes []string `json:"codes"`
+	}
+
+	span.AddEvent("read request body")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Codes) > 0, "codes", "must contain at least one permission code")
+	v.Check(validator.Unique(input.Codes), "codes", "must not contain duplicate values")
+
+	err = app.validatePermissionCodes(v, "codes", input.Codes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if user.ID == app.contextGetUser(r).ID {
+		app.grantNotPermittedResponse(w, r)
+		return
+	}
+
+	ok, err = app.canGrant(r, input.Codes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.grantNotPermittedResponse(w, r)
+		return
+	}
+
+	span.AddEvent("grant permissions in database")
+	err = app.models.Permissions.AddForUser(user.ID, input.Codes...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, code := range input.Codes {
+		app.logAdminAction(r, "grant_permission", user.ID, map[string]string{"code": code})
+	}
+
+	direct, err := app.models.Permissions.GetDirectForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"direct_permissions": direct}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) adminRevokePermissionHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin revoke permission")
+	defer span.End()
+
+	span.AddEvent("query user with id")
+	user, ok := app.readUserIDParam(w, r, params)
+	if !ok {
+		return
+	}
+
+	code := params.ByName("code")
+
+	v := validator.New()
+
+	err := app.validatePermissionCodes(v, "code", []string{code})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the same rules as granting, so nobody strips a permission they do not
+	// hold themselves, or one of their own
+	if user.ID == app.contextGetUser(r).ID {
+		app.grantNotPermittedResponse(w, r)
+		return
+	}
+
+	ok, err = app.canGrant(r, []string{code})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.grantNotPermittedResponse(w, r)
+		return
+	}
+
+	span.AddEvent("revoke permission in database")
+	err = app.models.Permissions.RemoveForUser(user.ID, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logAdminAction(r, "revoke_permission", user.ID, map[string]string{"code": code})
+
+	direct, err := app.models.Permissions.GetDirectForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"direct_permissions": direct}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) adminShowLogLevelHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin show log level")
+	defer span.End()
+
+	span.AddEvent("sending response")
+	err := app.writeJson(w, http.StatusOK, envelope{"level": app.logger.Level()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminUpdateLogLevelHandler changes the log level until the next restart,
+// e.g. to get DEBUG entries while investigating a problem.
+func (app *Application) adminUpdateLogLevelHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin update log level")
+	defer span.End()
+
+	var input struct {
+		Level string `json:"level"`
+	}
+
+	span.AddEvent("read request body")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	level, err := jsonlog.ParseLevel(input.Level)
+	v.Check(err == nil, "level", "must be debug, info, warn, error, fatal or off")
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	previous := app.logger.Level()
+
+	// audit entries are written at any level, including off
+	actor := app.contextGetUser(r)
+
+	app.logger.PrintAuditContext(r.Context(), "admin action", map[string]string{
+		"action":         "set_log_level",
+		"actor_id":       strconv.FormatInt(actor.ID, 10),
+		"previous_level": previous.String(),
+		"level":          level.String(),
+		"ip":             realip.FromRequest(r),
+	})
+
+	app.logger.SetLevel(level)
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"level": level, "previous_level": previous}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+func (app *Application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "list api keys")
+	defer span.End()
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("query user api keys")
+	keys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "create api key")
+	defer span.End()
+
+	var input struct {
+		Name        string     `json:"name"`
+		Expiry      *time.Time `json:"expiry"`
+		Permissions []string   `json:"permissions"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Permissions == nil {
+		input.Permissions = []string{}
+	}
+
+	user := app.contextGetUser(r)
+
+	key := &data.APIKey{
+		UserID:      user.ID,
+		Name:        input.Name,
+		Expiry:      input.Expiry,
+		Permissions: input.Permissions,
+	}
+
+	v := validator.New()
+
+	data.ValidateAPIKey(v, key)
+	data.ValidateAPIKeyExpiry(v, key.Expiry)
+
+	err = app.validateAPIKeyPermissions(r, v, key.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("insert api key into database")
+	key, err = app.models.APIKeys.New(user.ID, key.Name, key.Expiry, key.Permissions)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateAPIKeyName):
+			v.AddError("name", "an api key with this name already exists")
+			app.faildValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the plaintext key is only ever returned here
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) showAPIKeyHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "show api key")
+	defer span.End()
+
+	id, err := app.readIDParam(params)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("query api key with id")
+	key, err := app.models.APIKeys.GetForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) updateAPIKeyHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "update api key")
+	defer span.End()
+
+	id, err := app.readIDParam(params)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("query api key with id")
+	key, err := app.models.APIKeys.GetForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// expiry is kept raw to tell a missing field, which keeps the expiry,
+	// from an explicit null, which removes it
+	var input struct {
+		Name        *string         `json:"name"`
+		Expiry      json.RawMessage `json:"expiry"`
+		Permissions []string        `json:"permissions"`
+	}
+
+	span.AddEvent("read request body")
+	err = app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		key.Name = *input.Name
+	}
+
+	if input.Expiry != nil {
+		var expiry *time.Time
+
+		err = json.Unmarshal(input.Expiry, &expiry)
+		if err != nil {
+			app.badRequestResponse(w, r, errors.New(`body contains incorrect JSON type for field "expiry"`))
+			return
+		}
+
+		key.Expiry = expiry
+	}
+
+	if input.Permissions != nil {
+		key.Permissions = input.Permissions
+	}
+
+	v := validator.New()
+
+	data.ValidateAPIKey(v, key)
+
+	if input.Expiry != nil {
+		data.ValidateAPIKeyExpiry(v, key.Expiry)
+	}
+
+	err = app.validateAPIKeyPermissions(r, v, key.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("update api key in database")
+	err = app.models.APIKeys.Update(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateAPIKeyName):
+			v.AddError("name", "an api key with this name already exists")
+			app.faildValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "delete api key")
+	defer span.End()
+
+	id, err := app.readIDParam(params)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("delete api key from database")
+	err = app.models.APIKeys.DeleteForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "api key deleted successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// validateAPIKeyPermissions checks that every requested code is held by the
+// authenticated user.
+func (app *Application) validateAPIKeyPermissions(r *http.Request, v *validator.Validator, codes []string) error {
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		v.Check(permissions.Include(code), "permissions", "must be a subset of your own permissions")
+	}
+
+	return nil
+}
@@ -5,13 +5,33 @@ import (
 	"net/http"
 
 	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/jsonlog"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey         = contextKey("user")
+	permissionsContextKey  = contextKey("permissions")
+	apiKeyContextKey       = contextKey("api_key")
+	oauthTokenContextKey   = contextKey("oauth_token")
+	requestIDContextKey    = contextKey("request_id")
+	accessRecordContextKey = contextKey("access_record")
+)
+
+// accessRecord carries what is learned about a request while it is handled
+// back to the access log, which wraps the authentication middleware.
+type accessRecord struct {
+	userID int64
+	// route is the pattern of the matched route, e.g. /v1/movies/:id
+	route string
+}
 
 func (app *Application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if rec, ok := r.Context().Value(accessRecordContextKey).(*accessRecord); ok && !user.IsAnonymous() {
+		rec.userID = user.ID
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -25,3 +45,63 @@ func (app *Application) contextGetUser(r *http.Request) *data.User {
 
 	return u
 }
+
+// contextSetPermissions stores permissions that were already resolved while
+// authenticating, e.g. from JWT claims, so they are not loaded again.
+func (app *Application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+func (app *Application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	p, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return p, ok
+}
+
+func (app *Application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+func (app *Application) contextGetAPIKey(r *http.Request) (*data.APIKey, bool) {
+	k, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return k, ok
+}
+
+// contextSetOAuthToken marks the request as made by a third-party client on
+// behalf of the user.
+func (app *Application) contextSetOAuthToken(r *http.Request, token *data.Token) *http.Request {
+	ctx := context.WithValue(r.Context(), oauthTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+func (app *Application) contextGetOAuthToken(r *http.Request) (*data.Token, bool) {
+	t, ok := r.Context().Value(oauthTokenContextKey).(*data.Token)
+	return t, ok
+}
+
+func (app *Application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+func (app *Application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// logCorrelation finds the request id and the authenticated user in the
+// request context for the log entries written while handling the request.
+func logCorrelation(ctx context.Context) jsonlog.Correlation {
+	var c jsonlog.Correlation
+
+	c.RequestID, _ = ctx.Value(requestIDContextKey).(string)
+
+	if user, ok := ctx.Value(userContextKey).(*data.User); ok && !user.IsAnonymous() {
+		c.UserID = user.ID
+	} else if rec, ok := ctx.Value(accessRecordContextKey).(*accessRecord); ok {
+		c.UserID = rec.userID
+	}
+
+	return c
+}
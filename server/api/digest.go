@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+)
+
+// startDigestJob looks for due new-release digests every digest interval
+// until ctx is cancelled.
+func (app *Application) startDigestJob(ctx context.Context) {
+	if app.config.digest.interval <= 0 {
+		return
+	}
+
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(app.config.digest.interval)
+		defer ticker.Stop()
+
+		for {
+			app.runDigests(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	app.logger.PrintInfo("digest job started", map[string]string{
+		"interval": app.config.digest.interval.String(),
+	})
+}
+
+// runDigests queues the digests of every user whose digest is due. Several
+// instances can run it at the same time, every user is claimed only once.
+func (app *Application) runDigests(ctx context.Context) {
+	for ctx.Err() == nil {
+		recipients, err := app.models.Notifications.ClaimDue(app.config.digest.batchSize)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		for _, recipient := range recipients {
+			err := app.queueDigest(recipient)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"user_id": strconv.FormatInt(recipient.UserID, 10),
+				})
+			}
+		}
+
+		if len(recipients) < app.config.digest.batchSize {
+			return
+		}
+	}
+}
+
+// queueDigest puts the digest of the movies added since the previous digest
+// into the outbox. Nothing is sent when there are no new movies.
+func (app *Application) queueDigest(recipient *data.DigestRecipient) error {
+	movies, err := app.models.Movies.GetCreatedSince(recipient.Since, recipient.Genres, app.config.digest.maxMovies)
+	if err != nil {
+		return err
+	}
+
+	if len(movies) == 0 {
+		return nil
+	}
+
+	items := make([]map[string]any, 0, len(movies))
+	for _, movie := range movies {
+		items = append(items, map[string]any{
+			"title":  movie.Title,
+			"year":   movie.Year,
+			"genres": strings.Join(movie.Genres, ", "),
+		})
+	}
+
+	return app.models.Outbox.Enqueue(recipient.Email, recipient.Language, "movie_digest.tmpl.html", map[string]any{
+		"name":           recipient.Name,
+		"frequency":      recipient.Frequency,
+		"movies":         items,
+		"unsubscribeURL": app.unsubscribeURL(recipient.UserID),
+	})
+}
+
+func (app *Application) unsubscribeURL(userID int64) string {
+	query := url.Values{"token": {app.unsubscribe.Token(userID)}}
+
+	return strings.TrimSuffix(app.config.baseURL, "/") + "/v1/notifications/unsubscribe?" + query.Encode()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/mailer"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+const templateSuffix = ".tmpl.html"
+
+// renderTemplateFixture renders the template named in the url with its
+// fixture data. It writes the error response itself and reports whether
+// rendering succeeded.
+func (app *Application) renderTemplateFixture(w http.ResponseWriter, r *http.Request, params httprouter.Params, recipient, locale string) (*mailer.Message, bool) {
+	file := params.ByName("name") + templateSuffix
+
+	fixture, ok := mailer.Fixture(file)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	msg, err := app.mailer.Render(recipient, locale, file, fixture)
+	if err != nil {
+		switch {
+		case errors.Is(err, mailer.ErrUnknownTemplate):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return msg, true
+}
+
+func (app *Application) adminListEmailTemplatesHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin list email templates")
+	defer span.End()
+
+	type emailTemplate struct {
+		Name    string   `json:"name"`
+		File    string   `json:"file"`
+		Locales []string `json:"locales"`
+	}
+
+	templates := []emailTemplate{}
+	for _, file := range app.mailer.Templates() {
+		templates = append(templates, emailTemplate{
+			Name:    strings.TrimSuffix(file, templateSuffix),
+			File:    file,
+			Locales: app.mailer.TemplateLocales(file),
+		})
+	}
+
+	span.AddEvent("sending response")
+	err := app.writeJson(w, http.StatusOK, envelope{"templates": templates, "locales": app.mailer.Locales()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminPreviewEmailTemplateHandler responds with the rendered html or plain
+// text body, so the preview can be opened directly in a browser.
+func (app *Application) adminPreviewEmailTemplateHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin preview email template")
+	defer span.End()
+
+	span.AddEvent("reading url query string and validating")
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	format := app.readString(qs, "format", "html")
+	locale := app.readString(qs, "locale", mailer.DefaultLocale)
+
+	v.Check(validator.In(format, "html", "text"), "format", "must be html or text")
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("rendering template")
+	msg, ok := app.renderTemplateFixture(w, r, params, "preview@example.com", locale)
+	if !ok {
+		return
+	}
+
+	body, contentType := msg.HTMLBody, "text/html; charset=utf-8"
+	if format == "text" {
+		body, contentType = msg.PlainBody, "text/plain; charset=utf-8"
+	}
+
+	span.AddEvent("sending response")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Language", msg.Locale)
+	w.Header().Set("X-Email-Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(body))
+}
+
+func (app *Application) adminSendTestEmailHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin send test email")
+	defer span.End()
+
+	var input struct {
+		Email  string `json:"email"`
+		Locale string `json:"locale"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(len(input.Locale) <= 35, "locale", "must not be more than 35 bytes long")
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("rendering template")
+	msg, ok := app.renderTemplateFixture(w, r, params, input.Email, input.Locale)
+	if !ok {
+		return
+	}
+
+	// sent directly instead of through the outbox so delivery errors are
+	// reported to the caller
+	span.AddEvent("sending email")
+	err = app.mailer.Deliver(msg)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	actor := app.contextGetUser(r)
+
+	app.logger.PrintAuditContext(r.Context(), "admin action", map[string]string{
+		"action":    "send_test_email",
+		"actor_id":  strconv.FormatInt(actor.ID, 10),
+		"template":  msg.Template,
+		"locale":    msg.Locale,
+		"recipient": msg.To,
+		"ip":        realip.FromRequest(r),
+	})
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusAccepted, envelope{"message": "test email sent to " + msg.To, "locale": msg.Locale}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -2,16 +2,28 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// logError leaves out the query string, it may carry tokens like the one of
+// unsubscribe links.
 func (app *Application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, nil)
+	app.logger.PrintErrorContext(r.Context(), err, map[string]string{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	})
 }
 
 func (app *Application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
 	data := envelope{"error": message}
 
+	if id := app.contextGetRequestID(r); id != "" {
+		data["request_id"] = id
+	}
+
 	err := app.writeJson(w, status, data, nil)
 
 	if err != nil {
@@ -62,6 +74,7 @@ func (app *Application) badRequestResponse(w http.ResponseWriter, r *http.Reques
 
 func (app *Application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.Header().Add("WWW-Authenticate", "ApiKey")
 	message := "Invalid or missing authentication token"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
@@ -80,3 +93,71 @@ func (app *Application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "you do not have permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *Application) grantNotPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you can only grant or revoke permissions you hold yourself, and not on your own account"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *Application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *Application) builtInRoleResponse(w http.ResponseWriter, r *http.Request) {
+	message := "built-in roles can not be deleted"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *Application) emailNotFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "only failed emails can be requeued"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *Application) userNotManageableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you can only change accounts whose permissions you hold yourself"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *Application) sessionsUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "sessions can not be listed or revoked in jwt token mode, access tokens are not stored and expire on their own"
+	app.errorResponse(w, r, http.StatusNotImplemented, message)
+}
+
+func (app *Application) lockedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account is locked"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *Application) invalidMFACodeResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired two-factor authentication code"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *Application) invalidMagicLinkResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid, expired or already used login link"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *Application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// oauthErrorResponse writes an error in the format of RFC 6749 section 5.2,
+// which oauth client libraries expect instead of our usual envelope.
+func (app *Application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	if status == http.StatusUnauthorized {
+		headers.Set("WWW-Authenticate", `Basic realm="greenlight"`)
+	}
+
+	err := app.writeJson(w, status, envelope{"error": code, "error_description": description}, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
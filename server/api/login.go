@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/tomasen/realip"
+)
+
+// loginThrottle counts failed logins per client IP, independently of the
+// account that was targeted, so credential stuffing across many accounts is
+// slowed down as well.
+type loginThrottle struct {
+	mu      sync.Mutex
+	clients map[string]*loginFailures
+	max     int
+	window  time.Duration
+}
+
+type loginFailures struct {
+	count     int
+	firstSeen time.Time
+}
+
+func newLoginThrottle(max int, window time.Duration) *loginThrottle {
+	t := &loginThrottle{
+		clients: make(map[string]*loginFailures),
+		max:     max,
+		window:  window,
+	}
+
+	// go routine for stale clients cleaning
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			t.mu.Lock()
+
+			for ip, failures := range t.clients {
+				if time.Since(failures.firstSeen) > t.window {
+					delete(t.clients, ip)
+				}
+			}
+			t.mu.Unlock()
+		}
+	}()
+
+	return t
+}
+
+// blocked returns how long ip has to wait before trying again.
+func (t *loginThrottle) blocked(ip string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	failures, found := t.clients[ip]
+	if !found || failures.count < t.max {
+		return 0, false
+	}
+
+	wait := time.Until(failures.firstSeen.Add(t.window))
+	if wait <= 0 {
+		delete(t.clients, ip)
+		return 0, false
+	}
+
+	return wait, true
+}
+
+func (t *loginThrottle) fail(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	failures, found := t.clients[ip]
+	if !found || time.Since(failures.firstSeen) > t.window {
+		failures = &loginFailures{firstSeen: time.Now()}
+		t.clients[ip] = failures
+	}
+
+	failures.count++
+}
+
+// loginBlockedFor returns how long the account has to wait before the next
+// login attempt, either because it is locked out or because of the
+// exponential backoff that starts after a few failed attempts.
+func (app *Application) loginBlockedFor(user *data.User) (time.Duration, bool) {
+	now := time.Now()
+
+	if user.LockedUntil != nil && user.LockedUntil.After(now) {
+		return user.LockedUntil.Sub(now), true
+	}
+
+	cfg := app.config.login
+	if user.LastFailedLoginAt == nil || user.FailedLoginAttempts < cfg.backoffAfter {
+		return 0, false
+	}
+
+	exponent := float64(user.FailedLoginAttempts - cfg.backoffAfter)
+	backoff := time.Duration(float64(cfg.backoffBase) * math.Pow(2, exponent))
+	if backoff > cfg.backoffMax || backoff <= 0 {
+		backoff = cfg.backoffMax
+	}
+
+	wait := time.Until(user.LastFailedLoginAt.Add(backoff))
+	if wait <= 0 {
+		return 0, false
+	}
+
+	return wait, true
+}
+
+// recordLoginFailure counts a failed attempt for the client IP and, when the
+// account is known, for the account. The owner is notified by email when the
+// attempt locks the account.
+func (app *Application) recordLoginFailure(r *http.Request, user *data.User) error {
+	ip := realip.FromRequest(r)
+	app.loginThrottle.fail(ip)
+
+	if user == nil {
+		return nil
+	}
+
+	err := app.models.Users.RecordLoginFailure(user, app.config.login.maxAttempts, app.config.login.lockout)
+	if err != nil {
+		return err
+	}
+
+	if user.FailedLoginAttempts != app.config.login.maxAttempts || user.LockedUntil == nil {
+		return nil
+	}
+
+	app.logger.PrintInfoContext(r.Context(), "account locked after failed logins", map[string]string{
+		"user_id":  strconv.FormatInt(user.ID, 10),
+		"attempts": strconv.Itoa(user.FailedLoginAttempts),
+		"ip":       ip,
+	})
+
+	return app.models.Outbox.Enqueue(user.Email, user.Language, "account_locked.tmpl.html", map[string]any{
+		"attempts":    user.FailedLoginAttempts,
+		"ip":          ip,
+		"lockedUntil": user.LockedUntil.Format(time.RFC1123),
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+func (app *Application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx, span := app.config.tracer.Start(r.Context(), "create magic link token")
+	defer span.End()
+
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("checking client ip throttle")
+	if retryAfter, blocked := app.loginThrottle.blocked(realip.FromRequest(r)); blocked {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	// the account is looked up and the link emailed in the background, so
+	// registered and unknown addresses get the same response in the same
+	// time and the endpoint can not be used to enumerate accounts
+	bgCtx := context.WithoutCancel(ctx)
+	email := input.Email
+
+	app.background(func() {
+		err := app.sendMagicLink(bgCtx, email)
+		if err != nil {
+			app.logger.PrintErrorContext(bgCtx, err, nil)
+		}
+	})
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusAccepted, envelope{"message": "if the email address is registered, an email will be sent to it containing a login link"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// sendMagicLink emails a login link to the account of email, unless there is
+// no such account, it can not log in or it got a link moments ago.
+func (app *Application) sendMagicLink(ctx context.Context, email string) error {
+	ctx, span := app.config.tracer.Start(ctx, "send magic link")
+	defer span.End()
+
+	span.AddEvent("query user")
+	user, err := app.models.Users.GetByEmail(email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	if !user.Activated || user.Locked {
+		return nil
+	}
+
+	if _, blocked := app.loginBlockedFor(user); blocked {
+		return nil
+	}
+
+	span.AddEvent("checking magic link cooldown")
+	recent, err := app.models.Tokens.CountCreatedSince(user.ID, data.ScopeMagicLink, time.Now().Add(-app.config.auth.magicLinkCooldown))
+	if err != nil {
+		return err
+	}
+
+	if recent > 0 {
+		return nil
+	}
+
+	span.AddEvent("create magic link token")
+	// only the latest link is valid
+	err = app.models.Tokens.DeleteAllForUser(user.ID, data.ScopeMagicLink)
+	if err != nil {
+		return err
+	}
+
+	ttl := app.config.auth.magicLinkTTL
+
+	token, err := app.models.Tokens.New(ctx, user.ID, ttl, data.ScopeMagicLink, app.config.tracer)
+	if err != nil {
+		return err
+	}
+
+	return app.models.Outbox.Enqueue(user.Email, user.Language, "token_magic_link.tmpl.html", map[string]any{
+		"magicLinkToken": token.Plaintext,
+		"ttl":            ttl.String(),
+	})
+}
+
+func (app *Application) consumeMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx, span := app.config.tracer.Start(r.Context(), "consume magic link token")
+	defer span.End()
+
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("checking client ip throttle")
+	if retryAfter, blocked := app.loginThrottle.blocked(realip.FromRequest(r)); blocked {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	span.AddEvent("consuming token")
+	userID, err := app.models.Tokens.Consume(data.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			err = app.recordLoginFailure(r, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.invalidMagicLinkResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("query user")
+	user, err := app.models.Users.Get(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter, blocked := app.loginBlockedFor(user); blocked {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	if user.Locked {
+		app.lockedAccountResponse(w, r)
+		return
+	}
+
+	// failed logins are reset by completeLogin, or after the second factor
+	app.completeLogin(ctx, w, r, user)
+}
@@ -2,19 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"expvar"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"os/signal"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mahmoud-shabban/greenlight/internal/data"
 	"github.com/mahmoud-shabban/greenlight/internal/jsonlog"
+	"github.com/mahmoud-shabban/greenlight/internal/jwt"
+	"github.com/mahmoud-shabban/greenlight/internal/logfile"
 	"github.com/mahmoud-shabban/greenlight/internal/mailer"
+	"github.com/mahmoud-shabban/greenlight/internal/oidc"
+	"github.com/mahmoud-shabban/greenlight/internal/passhash"
+	"github.com/mahmoud-shabban/greenlight/internal/pwpolicy"
 	"github.com/mahmoud-shabban/greenlight/internal/tracing"
+	"github.com/mahmoud-shabban/greenlight/internal/unsubscribe"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -25,9 +38,10 @@ var (
 )
 
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port    int
+	env     string
+	baseURL string
+	db      struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
@@ -46,18 +60,119 @@ type config struct {
 		password string
 		sender   string
 	}
+	mail struct {
+		transport string
+		dir       string
+	}
+	outbox struct {
+		workers      int
+		batchSize    int
+		pollInterval time.Duration
+		lease        time.Duration
+		maxAttempts  int
+		backoffBase  time.Duration
+		backoffMax   time.Duration
+	}
+	log struct {
+		level       jsonlog.Level
+		stackTraces bool
+		file        string
+		maxSize     int
+		daily       bool
+		maxAge      time.Duration
+		maxBackups  int
+		compress    bool
+	}
+	otel struct {
+		exporter    string
+		endpoint    string
+		file        string
+		sampleRatio float64
+		parentBased bool
+		serviceName string
+	}
+	accessLog struct {
+		format      string
+		exclude     []string
+		sampleAfter int
+		sampleRate  float64
+	}
+	digest struct {
+		interval          time.Duration
+		batchSize         int
+		maxMovies         int
+		unsubscribeSecret string
+	}
 	cors struct {
 		trustedOrigins []string
 	}
+	auth struct {
+		defaultRole       string
+		accessTokenTTL    time.Duration
+		refreshTokenTTL   time.Duration
+		tokenMode         string
+		totpIssuer        string
+		magicLinkTTL      time.Duration
+		magicLinkCooldown time.Duration
+		jwt               struct {
+			keysDir   string
+			activeKID string
+			issuer    string
+		}
+	}
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+		defaultRole  string
+		jwksCacheTTL time.Duration
+	}
+	oauth struct {
+		accessTokenTTL time.Duration
+		codeTTL        time.Duration
+	}
+	login struct {
+		maxAttempts   int
+		lockout       time.Duration
+		backoffAfter  int
+		backoffBase   time.Duration
+		backoffMax    time.Duration
+		ipMaxFailures int
+		ipWindow      time.Duration
+	}
+	password struct {
+		minLength     int
+		minEntropy    float64
+		breachedList  string
+		hasher        string
+		argon2Memory  int
+		argon2Time    int
+		argon2Threads int
+		bcryptCost    int
+	}
 	tracer trace.Tracer
 }
 
 type Application struct {
-	logger *jsonlog.Logger
-	config config
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	logger  *jsonlog.Logger
+	config  config
+	models  data.Models
+	mailer  mailer.Mailer
+	jwtKeys *jwt.KeySet
+	wg      sync.WaitGroup
+
+	passwordPolicy *pwpolicy.Policy
+
+	loginThrottle *loginThrottle
+	accessLogger  *accessLogger
+
+	oidcProvider *oidc.Provider
+	oidcStates   *oidcStates
+
+	unsubscribe *unsubscribe.Signer
+
+	tracerProvider *tracing.Provider
 }
 
 func main() {
@@ -66,6 +181,7 @@ func main() {
 
 	flag.IntVar(&cfg.port, "port", 8080, "server port to listen on")
 	flag.StringVar(&cfg.env, "env", "dev", "server environment")
+	flag.StringVar(&cfg.baseURL, "base-url", "http://localhost:8080", "Public url of the API, used for links in emails")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "postgres database connection string")
 	// db config
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-cons", 25, "PostgreSQL max open connections")
@@ -81,6 +197,26 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtp-username", "api", "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "56fd11b2ddb54923f2a81d1bf950c4d8", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <hello@demomailtrap.co>", "SMTP sender")
+
+	// mail transport settings
+	flag.StringVar(&cfg.mail.transport, "mail-transport", "smtp", "Mail transport (smtp|file|log)")
+	flag.StringVar(&cfg.mail.dir, "mail-dir", "./tmp/mail", "Directory the file mail transport writes .eml files to")
+
+	// email outbox settings
+	flag.IntVar(&cfg.outbox.workers, "outbox-workers", 2, "Number of email outbox workers")
+	flag.IntVar(&cfg.outbox.batchSize, "outbox-batch-size", 10, "Emails claimed by an outbox worker at once")
+	flag.DurationVar(&cfg.outbox.pollInterval, "outbox-poll-interval", 5*time.Second, "How often idle outbox workers look for due emails")
+	flag.DurationVar(&cfg.outbox.lease, "outbox-lease", 2*time.Minute, "How long a claimed email is locked before another worker may retry it")
+	flag.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 8, "Delivery attempts before an email is moved to the dead-letter state")
+	flag.DurationVar(&cfg.outbox.backoffBase, "outbox-backoff-base", 30*time.Second, "Delay before the first delivery retry")
+	flag.DurationVar(&cfg.outbox.backoffMax, "outbox-backoff-max", time.Hour, "Maximum delay between delivery retries")
+
+	// new-release digest settings
+	flag.DurationVar(&cfg.digest.interval, "digest-interval", time.Hour, "How often due digest emails are looked for (0 disables digests)")
+	flag.IntVar(&cfg.digest.batchSize, "digest-batch-size", 100, "Digests claimed at once")
+	flag.IntVar(&cfg.digest.maxMovies, "digest-max-movies", 20, "Maximum number of movies in a digest email")
+	flag.StringVar(&cfg.digest.unsubscribeSecret, "unsubscribe-secret", "", "Key for signing unsubscribe links, at least 32 bytes (digests are disabled when empty)")
+
 	// cors trusted origins
 	flag.Func("cors-trusted-origins", "Truested CORS origins (space separated)", func(val string) error {
 
@@ -89,6 +225,77 @@ func main() {
 
 	})
 
+	// authentication and authorization settings
+	flag.StringVar(&cfg.auth.defaultRole, "auth-default-role", "viewer", "Role assigned to newly registered users")
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "auth-access-ttl", 15*time.Minute, "Authentication (access) token lifetime")
+	flag.DurationVar(&cfg.auth.refreshTokenTTL, "auth-refresh-ttl", 30*24*time.Hour, "Refresh token lifetime")
+	flag.StringVar(&cfg.auth.totpIssuer, "totp-issuer", "Greenlight", "Issuer name shown by authenticator apps")
+	flag.DurationVar(&cfg.auth.magicLinkTTL, "auth-magic-link-ttl", 15*time.Minute, "Magic login link lifetime")
+	flag.DurationVar(&cfg.auth.magicLinkCooldown, "auth-magic-link-cooldown", time.Minute, "Minimum time between two magic login links for the same account")
+	flag.StringVar(&cfg.auth.tokenMode, "auth-token-mode", "opaque", "Authentication token mode to issue (opaque|jwt)")
+	flag.StringVar(&cfg.auth.jwt.keysDir, "jwt-keys-dir", "", "Directory with JWT signing keys (<kid>.key for HS256, <kid>.pem for EdDSA)")
+	flag.StringVar(&cfg.auth.jwt.activeKID, "jwt-active-kid", "", "Key id used to sign new JWTs, required when the keys dir has several signing keys")
+	flag.StringVar(&cfg.auth.jwt.issuer, "jwt-issuer", "greenlight", "JWT issuer claim")
+
+	// login brute-force protection settings
+	flag.IntVar(&cfg.login.maxAttempts, "login-max-attempts", 10, "Failed logins before an account is temporarily locked")
+	flag.DurationVar(&cfg.login.lockout, "login-lockout", 15*time.Minute, "Temporary account lockout duration")
+	flag.IntVar(&cfg.login.backoffAfter, "login-backoff-after", 3, "Failed logins before exponential backoff starts")
+	flag.DurationVar(&cfg.login.backoffBase, "login-backoff-base", time.Second, "Initial login backoff delay")
+	flag.DurationVar(&cfg.login.backoffMax, "login-backoff-max", time.Minute, "Maximum login backoff delay")
+	flag.IntVar(&cfg.login.ipMaxFailures, "login-ip-max-failures", 50, "Failed logins per client IP before it is blocked")
+	flag.DurationVar(&cfg.login.ipWindow, "login-ip-window", 15*time.Minute, "Window for counting failed logins per client IP")
+
+	// openid connect login settings
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect issuer url of the identity provider (empty disables OIDC login)")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client id")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "", "Redirect url registered at the identity provider")
+	flag.StringVar(&cfg.oidc.defaultRole, "oidc-default-role", "", "Role assigned to users provisioned on their first OIDC login (defaults to -auth-default-role)")
+	flag.DurationVar(&cfg.oidc.jwksCacheTTL, "oidc-jwks-cache-ttl", time.Hour, "How long identity provider signing keys are cached")
+
+	// oauth2 authorization server settings
+	flag.DurationVar(&cfg.oauth.accessTokenTTL, "oauth-access-ttl", time.Hour, "OAuth2 access token lifetime")
+	flag.DurationVar(&cfg.oauth.codeTTL, "oauth-code-ttl", 5*time.Minute, "OAuth2 authorization code lifetime")
+
+	// password policy settings
+	flag.IntVar(&cfg.password.minLength, "password-min-length", 8, "Minimum password length in bytes")
+	flag.Float64Var(&cfg.password.minEntropy, "password-min-entropy", 40, "Minimum estimated password strength in bits (0 disables the check)")
+	flag.StringVar(&cfg.password.breachedList, "password-breached-list", "", "File with breached passwords or SHA-1 digests, one per line")
+	flag.StringVar(&cfg.password.hasher, "password-hasher", "argon2id", "Algorithm for new password hashes (argon2id|bcrypt)")
+	flag.IntVar(&cfg.password.argon2Memory, "argon2-memory", 64*1024, "Argon2id memory cost in KiB")
+	flag.IntVar(&cfg.password.argon2Time, "argon2-time", 3, "Argon2id number of passes")
+	flag.IntVar(&cfg.password.argon2Threads, "argon2-threads", 2, "Argon2id degree of parallelism")
+	flag.IntVar(&cfg.password.bcryptCost, "bcrypt-cost", 12, "Bcrypt cost")
+
+	// logging settings
+	flag.TextVar(&cfg.log.level, "log-level", jsonlog.LevelInfo, "Minimum log level (debug|info|warn|error|fatal|off)")
+	flag.BoolVar(&cfg.log.stackTraces, "log-stack-traces", false, "Include stack traces in ERROR and FATAL log entries")
+	flag.StringVar(&cfg.log.file, "log-file", "", "File to write logs to, reopened on SIGHUP (stdout when empty)")
+	flag.IntVar(&cfg.log.maxSize, "log-max-size", 100, "Size in MB a log file grows to before it is rotated (0 disables size rotation)")
+	flag.BoolVar(&cfg.log.daily, "log-rotate-daily", false, "Rotate the log file every day")
+	flag.DurationVar(&cfg.log.maxAge, "log-max-age", 0, "Remove rotated log files older than this (0 keeps them)")
+	flag.IntVar(&cfg.log.maxBackups, "log-max-backups", 0, "Number of rotated log files kept (0 keeps all)")
+	flag.BoolVar(&cfg.log.compress, "log-compress", true, "Gzip rotated log files")
+
+	// opentelemetry tracing settings
+	flag.StringVar(&cfg.otel.exporter, "otel-exporter", tracing.ExporterOTLPHTTP, "Trace exporter (otlp-http|otlp-grpc|stdout|file|none)")
+	flag.StringVar(&cfg.otel.endpoint, "otel-endpoint", "", "OTLP collector url (the exporter default or OTEL_EXPORTER_OTLP_ENDPOINT when empty)")
+	flag.StringVar(&cfg.otel.file, "otel-file", "./tmp/traces.jsonl", "File the file trace exporter appends spans to")
+	flag.Float64Var(&cfg.otel.sampleRatio, "otel-sample-ratio", 1, "Share of new traces that are sampled")
+	flag.BoolVar(&cfg.otel.parentBased, "otel-sampler-parent-based", true, "Follow the sampling decision of the caller for requests with a traceparent header")
+	flag.StringVar(&cfg.otel.serviceName, "otel-service-name", "greenlight", "Service name reported to the trace backend")
+
+	// access log settings
+	flag.StringVar(&cfg.accessLog.format, "access-log-format", accessLogJSON, "Access log format (json|combined|none)")
+	cfg.accessLog.exclude = []string{"/v1/healthcheck"}
+	flag.Func("access-log-exclude", "Paths or route patterns left out of the access log (space separated, default /v1/healthcheck)", func(val string) error {
+		cfg.accessLog.exclude = strings.Fields(val)
+		return nil
+	})
+	flag.IntVar(&cfg.accessLog.sampleAfter, "access-log-sample-after", 0, "Successful requests logged per second before sampling starts (0 disables sampling)")
+	flag.Float64Var(&cfg.accessLog.sampleRate, "access-log-sample-rate", 0.1, "Share of successful requests logged once sampling started")
+
 	displayVersion := flag.Bool("version", false, "Display the version and exit")
 
 	flag.Parse()
@@ -98,9 +305,148 @@ func main() {
 		os.Exit(0)
 	}
 
-	// logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	var logOutput io.Writer = os.Stdout
+
+	if cfg.log.file != "" {
+		file, err := logfile.Open(cfg.log.file, logfile.Options{
+			MaxSize:    int64(cfg.log.maxSize) * 1024 * 1024,
+			Daily:      cfg.log.daily,
+			MaxAge:     cfg.log.maxAge,
+			MaxBackups: cfg.log.maxBackups,
+			Compress:   cfg.log.compress,
+			// the log file can not report its own rotation failures
+			OnRotateError: func(err error) {
+				fmt.Fprintf(os.Stderr, "rotating log file: %v\n", err)
+			},
+		})
+		if err != nil {
+			jsonlog.New(os.Stdout, cfg.log.level).PrintFatal(err, nil)
+		}
+		defer file.Close()
+
+		// external rotation (logrotate) moves the file away and sends SIGHUP
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+
+			for range hup {
+				err := file.Reopen()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "reopening log file: %v\n", err)
+				}
+			}
+		}()
+
+		logOutput = file
+	}
+
+	logger := jsonlog.New(logOutput, cfg.log.level)
+	logger.SetStackTraces(cfg.log.stackTraces)
+	logger.SetCorrelation(logCorrelation)
+
+	// libraries logging through log/slog or the standard log package end up
+	// in the same json log
+	slog.SetDefault(slog.New(logger.Handler()))
+
+	if !slices.Contains(accessLogFormats, cfg.accessLog.format) {
+		logger.PrintError(fmt.Errorf("invalid -access-log-format %q, must be json, combined or none", cfg.accessLog.format), nil)
+		os.Exit(1)
+	}
+
+	if cfg.accessLog.sampleAfter < 0 || cfg.accessLog.sampleRate < 0 || cfg.accessLog.sampleRate > 1 {
+		logger.PrintError(fmt.Errorf("-access-log-sample-after must not be negative and -access-log-sample-rate must be between 0 and 1"), nil)
+		os.Exit(1)
+	}
+
+	if cfg.auth.tokenMode != "opaque" && cfg.auth.tokenMode != "jwt" {
+		logger.PrintError(fmt.Errorf("invalid auth token mode %q", cfg.auth.tokenMode), nil)
+		os.Exit(1)
+	}
+
+	var jwtKeys *jwt.KeySet
+	if cfg.auth.jwt.keysDir != "" {
+		keys, err := jwt.LoadKeySet(cfg.auth.jwt.keysDir, cfg.auth.jwt.activeKID, cfg.auth.jwt.issuer)
+		if err != nil {
+			logger.PrintError(err, nil)
+			os.Exit(1)
+		}
+
+		jwtKeys = keys
+
+		logger.PrintInfo("JWT signing keys loaded", map[string]string{
+			"active_kid": jwtKeys.ActiveKeyID(),
+		})
+	} else if cfg.auth.tokenMode == "jwt" {
+		logger.PrintError(fmt.Errorf("jwt token mode requires -jwt-keys-dir"), nil)
+		os.Exit(1)
+	}
+
+	if cfg.password.argon2Time < 1 || cfg.password.argon2Threads < 1 || cfg.password.argon2Threads > 255 {
+		logger.PrintError(fmt.Errorf("-argon2-time must be at least 1 and -argon2-threads between 1 and 255"), nil)
+		os.Exit(1)
+	}
+
+	// argon2 needs at least 8 KiB per thread, more than 4 GiB per hash is a typo
+	if cfg.password.argon2Memory < 8*cfg.password.argon2Threads || cfg.password.argon2Memory > 4*1024*1024 {
+		logger.PrintError(fmt.Errorf("-argon2-memory must be between %d and %d KiB", 8*cfg.password.argon2Threads, 4*1024*1024), nil)
+		os.Exit(1)
+	}
+
+	if cfg.password.bcryptCost < 4 || cfg.password.bcryptCost > 31 {
+		logger.PrintError(fmt.Errorf("-bcrypt-cost must be between 4 and 31"), nil)
+		os.Exit(1)
+	}
+
+	argon2id := passhash.DefaultArgon2id()
+	argon2id.Memory = uint32(cfg.password.argon2Memory)
+	argon2id.Time = uint32(cfg.password.argon2Time)
+	argon2id.Threads = uint8(cfg.password.argon2Threads)
+
+	bcryptHasher := passhash.Bcrypt{Cost: cfg.password.bcryptCost}
+
+	// hashes of the algorithm that is not the default are still verified and
+	// upgraded on the next login
+	// the longest password new hashes are made of depends on the algorithm
+	var maxPasswordLength int
+
+	switch cfg.password.hasher {
+	case "argon2id":
+		data.SetPasswordHasher(passhash.New(argon2id, bcryptHasher))
+		maxPasswordLength = passhash.Argon2idMaxLength
+	case "bcrypt":
+		data.SetPasswordHasher(passhash.New(bcryptHasher, argon2id))
+		maxPasswordLength = passhash.BcryptMaxLength
+	default:
+		logger.PrintError(fmt.Errorf("invalid -password-hasher %q, must be argon2id or bcrypt", cfg.password.hasher), nil)
+		os.Exit(1)
+	}
+
+	passwordPolicy := &pwpolicy.Policy{
+		MinLength:  cfg.password.minLength,
+		MaxLength:  maxPasswordLength,
+		MinEntropy: cfg.password.minEntropy,
+	}
+
+	if passwordPolicy.MinLength < 1 || passwordPolicy.MinLength > passwordPolicy.MaxLength {
+		logger.PrintError(fmt.Errorf("-password-min-length must be between 1 and %d", passwordPolicy.MaxLength), nil)
+		os.Exit(1)
+	}
+
+	if cfg.password.breachedList != "" {
+		filter, count, err := pwpolicy.LoadBreachedList(cfg.password.breachedList)
+		if err != nil {
+			logger.PrintError(err, nil)
+			os.Exit(1)
+		}
+
+		passwordPolicy.Breached = filter
+
+		logger.PrintInfo("breached passwords list loaded", map[string]string{
+			"entries": strconv.Itoa(count),
+			"bytes":   strconv.Itoa(filter.SizeBytes()),
+		})
+	}
 
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.PrintError(err, nil)
@@ -111,6 +457,107 @@ func main() {
 
 	logger.PrintInfo("DB connection pool stablished successfully.", nil)
 
+	models := data.NewModels(db)
+
+	_, err = models.Roles.GetByName(cfg.auth.defaultRole)
+	if err != nil {
+		logger.PrintError(fmt.Errorf("default role %q: %w", cfg.auth.defaultRole, err), nil)
+		os.Exit(1)
+	}
+
+	var mailTransport mailer.Transport
+	switch cfg.mail.transport {
+	case "smtp":
+		mailTransport = mailer.NewSMTPTransport(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password)
+	case "file":
+		mailTransport, err = mailer.NewFileTransport(cfg.mail.dir)
+		if err != nil {
+			logger.PrintError(err, nil)
+			os.Exit(1)
+		}
+	case "log":
+		mailTransport = &mailer.LogTransport{Logger: logger}
+	default:
+		logger.PrintError(fmt.Errorf("invalid -mail-transport %q, must be smtp, file or log", cfg.mail.transport), nil)
+		os.Exit(1)
+	}
+
+	if cfg.digest.batchSize < 1 || cfg.digest.maxMovies < 1 {
+		logger.PrintError(fmt.Errorf("-digest-batch-size and -digest-max-movies must be at least 1"), nil)
+		os.Exit(1)
+	}
+
+	// digest emails carry unsubscribe links, which must keep working across
+	// restarts and on every instance, so digests are only sent with a shared
+	// secret
+	unsubscribeKey := []byte(cfg.digest.unsubscribeSecret)
+	switch {
+	case len(unsubscribeKey) == 0:
+		if cfg.digest.interval > 0 {
+			logger.PrintWarn("no -unsubscribe-secret set, new-release digests are disabled", nil)
+			cfg.digest.interval = 0
+		}
+
+		unsubscribeKey = make([]byte, 32)
+
+		_, err = rand.Read(unsubscribeKey)
+		if err != nil {
+			logger.PrintError(err, nil)
+			os.Exit(1)
+		}
+	case len(unsubscribeKey) < 32:
+		logger.PrintError(fmt.Errorf("-unsubscribe-secret must be at least 32 bytes long"), nil)
+		os.Exit(1)
+	}
+
+	mail, err := mailer.New(mailTransport, cfg.smtp.sender)
+	if err != nil {
+		logger.PrintError(err, nil)
+		os.Exit(1)
+	}
+
+	logger.PrintInfo("mail transport configured", map[string]string{
+		"transport": cfg.mail.transport,
+		"locales":   strings.Join(mail.Locales(), ","),
+	})
+
+	if cfg.outbox.workers < 1 || cfg.outbox.batchSize < 1 || cfg.outbox.maxAttempts < 1 {
+		logger.PrintError(fmt.Errorf("-outbox-workers, -outbox-batch-size and -outbox-max-attempts must be at least 1"), nil)
+		os.Exit(1)
+	}
+
+	if cfg.oidc.defaultRole == "" {
+		cfg.oidc.defaultRole = cfg.auth.defaultRole
+	}
+
+	var oidcProvider *oidc.Provider
+	if cfg.oidc.issuer != "" {
+		_, err = models.Roles.GetByName(cfg.oidc.defaultRole)
+		if err != nil {
+			logger.PrintError(fmt.Errorf("oidc default role %q: %w", cfg.oidc.defaultRole, err), nil)
+			os.Exit(1)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		oidcProvider, err = oidc.Discover(ctx, oidc.Config{
+			Issuer:       cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+			JWKSCacheTTL: cfg.oidc.jwksCacheTTL,
+		})
+		cancel()
+
+		if err != nil {
+			logger.PrintError(err, nil)
+			os.Exit(1)
+		}
+
+		logger.PrintInfo("OIDC identity provider discovered", map[string]string{
+			"issuer": oidcProvider.Issuer(),
+		})
+	}
+
 	expvar.NewString("version").Set(version)
 	expvar.Publish("goroutines", expvar.Func(func() any {
 		return runtime.NumGoroutine()
@@ -124,28 +571,48 @@ func main() {
 		return time.Now().Unix()
 	}))
 
-	// OTEL Tracing Setup Section
-	ctx := context.Background()
-
-	exp, err := tracing.NewTracingExporter(ctx)
-
+	tracerProvider, err := tracing.NewProvider(context.Background(), tracing.Config{
+		Exporter:       cfg.otel.exporter,
+		Endpoint:       cfg.otel.endpoint,
+		File:           cfg.otel.file,
+		SampleRatio:    cfg.otel.sampleRatio,
+		ParentBased:    cfg.otel.parentBased,
+		ServiceName:    cfg.otel.serviceName,
+		ServiceVersion: version,
+		Environment:    cfg.env,
+	})
 	if err != nil {
-		panic(1)
+		logger.PrintError(fmt.Errorf("tracing: %w", err), nil)
+		os.Exit(1)
 	}
 
-	tp := tracing.NewTracingProvider(exp, "greenlight_3")
+	otel.SetTracerProvider(tracerProvider)
+	tracing.SetPropagation()
 
-	otel.SetTracerProvider(tp)
+	// export failures are logged, they never fail a request
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.PrintWarn("opentelemetry error", map[string]string{"error": err.Error()})
+	}))
 
 	cfg.tracer = otel.Tracer("mainTracer")
 
-	// End of OTEL Section
-
 	app := &Application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:  cfg,
+		logger:  logger,
+		models:  models,
+		mailer:  mail,
+		jwtKeys: jwtKeys,
+
+		loginThrottle:  newLoginThrottle(cfg.login.ipMaxFailures, cfg.login.ipWindow),
+		accessLogger:   newAccessLogger(logOutput, cfg.accessLog.format, cfg.accessLog.exclude, cfg.accessLog.sampleAfter, cfg.accessLog.sampleRate),
+		passwordPolicy: passwordPolicy,
+
+		oidcProvider: oidcProvider,
+		oidcStates:   newOIDCStates(10 * time.Minute),
+
+		unsubscribe: unsubscribe.NewSigner(unsubscribeKey),
+
+		tracerProvider: tracerProvider,
 	}
 
 	err = app.serve()
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
@@ -13,8 +16,13 @@ import (
 	"github.com/felixge/httpsnoop"
 	"github.com/julienschmidt/httprouter"
 	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/jwt"
 	"github.com/mahmoud-shabban/greenlight/internal/validator"
 	"github.com/tomasen/realip"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
@@ -87,25 +95,198 @@ func (app *Application) rateLimit(next http.Handler) http.Handler {
 }
 
 func (app *Application) authenticate(next http.Handler) http.Handler {
+
+	// last_used_at is only written once per sessionTouchInterval for each
+	// token or api key
+	const sessionTouchInterval = time.Minute
+
+	var (
+		mux     sync.Mutex
+		touched = make(map[string]time.Time)
+	)
+
+	// go routine for stale touched tokens and api keys cleaning
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			mux.Lock()
+
+			for token, lastTouched := range touched {
+				if time.Since(lastTouched) > 3*sessionTouchInterval {
+					delete(touched, token)
+				}
+			}
+			mux.Unlock()
+		}
+	}()
+
+	shouldTouch := func(key string, now time.Time) bool {
+		mux.Lock()
+		defer mux.Unlock()
+
+		if now.Sub(touched[key]) < sessionTouchInterval {
+			return false
+		}
+
+		touched[key] = now
+		return true
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 
 		authorizationHeader := r.Header.Get("Authorization")
+		apiKeyHeader := r.Header.Get("X-API-Key")
 
-		if authorizationHeader == "" {
+		if authorizationHeader == "" && apiKeyHeader == "" {
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			app.invalidAuthenticationTokenResponse(w, r)
+		scheme, token := "ApiKey", apiKeyHeader
+		if authorizationHeader != "" {
+			headerParts := strings.Split(authorizationHeader, " ")
+			if len(headerParts) != 2 || (headerParts[0] != "Bearer" && headerParts[0] != "ApiKey") {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			scheme, token = headerParts[0], headerParts[1]
+		}
+
+		if scheme == "ApiKey" {
+			v := validator.New()
+
+			if data.ValidateAPIKeyPlaintext(v, token); !v.Valid() {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			apiKey, user, err := app.models.APIKeys.GetWithUser(token)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecoredNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			if user.Locked {
+				app.lockedAccountResponse(w, r)
+				return
+			}
+
+			// an api key never grants more than its owner currently holds
+			userPermissions, err := app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			permissions := data.Permissions{}
+			for _, code := range apiKey.Permissions {
+				if userPermissions.Include(code) {
+					permissions = append(permissions, code)
+				}
+			}
+
+			now := time.Now()
+			if shouldTouch("api_key:"+strconv.FormatInt(apiKey.ID, 10), now) {
+				err = app.models.APIKeys.Touch(apiKey.ID, now)
+				if err != nil {
+					app.logError(r, err)
+				}
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetPermissions(r, permissions)
+			r = app.contextSetAPIKey(r, apiKey)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if data.IsOAuthAccessToken(token) {
+			v := validator.New()
+
+			if data.ValidateOAuthAccessTokenPlaintext(v, token); !v.Valid() {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			oauthToken, err := app.models.Tokens.GetOAuthAccess(token)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecoredNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			user, err := app.models.Users.Get(oauthToken.UserID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if user.Locked {
+				app.lockedAccountResponse(w, r)
+				return
+			}
+
+			// like api keys, an oauth token is limited to the granted scopes
+			// and never exceeds what the user currently holds
+			permissions, err := app.oauthPermissions(user.ID, oauthToken.OAuthScopes)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetPermissions(r, permissions)
+			r = app.contextSetOAuthToken(r, oauthToken)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if app.jwtKeys != nil && jwt.IsJWT(token) {
+			claims, err := app.jwtKeys.Verify(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			userID, err := claims.UserID()
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			// a jwt is checked without touching the database, so it stays
+			// valid for the short access token lifetime after the account
+			// was locked, refreshing it is refused
+			// the user is built from the claims only, handlers that need the
+			// full record must load it with Users.Get
+			user := &data.User{
+				ID:        userID,
+				Activated: claims.Activated,
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetPermissions(r, data.Permissions(claims.Permissions))
+
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		token := headerParts[1]
 		v := validator.New()
 
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
@@ -124,6 +305,21 @@ func (app *Application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if user.Locked {
+			app.lockedAccountResponse(w, r)
+			return
+		}
+
+		// keyed by the hash, so the map does not hold on to bearer tokens
+		now := time.Now()
+		tokenHash := sha256.Sum256([]byte(token))
+		if shouldTouch("token:"+hex.EncodeToString(tokenHash[:]), now) {
+			err = app.models.Tokens.TouchSession(token, now)
+			if err != nil {
+				app.logError(r, err)
+			}
+		}
+
 		r = app.contextSetUser(r, user)
 
 		next.ServeHTTP(w, r)
@@ -131,6 +327,27 @@ func (app *Application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// requireInteractiveUser rejects requests authenticated with an api key or an
+// oauth token, so delegated credentials can not be used to mint new ones or
+// to manage the sessions of the user.
+func (app *Application) requireInteractiveUser(next httprouter.Handle) httprouter.Handle {
+	fn := func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if _, ok := app.contextGetAPIKey(r); ok {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		if _, ok := app.contextGetOAuthToken(r); ok {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next(w, r, params)
+	}
+
+	return app.requiredActivatedUser(fn)
+}
+
 func (app *Application) requireAuthenticatedUser(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		user := app.contextGetUser(r)
@@ -158,18 +375,41 @@ func (app *Application) requiredActivatedUser(next httprouter.Handle) httprouter
 }
 
 func (app *Application) requirePermissions(code string, next httprouter.Handle) httprouter.Handle {
+	return app.requireAllPermissions([]string{code}, next)
+}
+
+func (app *Application) requireAnyPermission(codes []string, next httprouter.Handle) httprouter.Handle {
 	fn := func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 
-		user := app.contextGetUser(r)
+		permissions, err := app.userPermissions(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.IncludeAny(codes...) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next(w, r, params)
+	}
+
+	return app.requiredActivatedUser(fn)
+}
+
+func (app *Application) requireAllPermissions(codes []string, next httprouter.Handle) httprouter.Handle {
+	fn := func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+
+		permissions, err := app.userPermissions(r)
 
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 
-		if !permissions.Include(code) {
+		if !permissions.IncludeAll(codes...) {
 			app.notPermittedResponse(w, r)
 			return
 		}
@@ -180,6 +420,17 @@ func (app *Application) requirePermissions(code string, next httprouter.Handle)
 	return app.requiredActivatedUser(fn)
 }
 
+// userPermissions returns the permissions of the authenticated user, preferring
+// the ones carried by the request context over a database lookup.
+func (app *Application) userPermissions(r *http.Request) (data.Permissions, error) {
+	if permissions, ok := app.contextGetPermissions(r); ok {
+		return permissions, nil
+	}
+
+	user := app.contextGetUser(r)
+	return app.models.Permissions.GetAllForUser(user.ID)
+}
+
 func (app *Application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -192,11 +443,12 @@ func (app *Application) enableCORS(next http.Handler) http.Handler {
 			for i := range app.config.cors.trustedOrigins {
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", app.config.cors.trustedOrigins[i])
+					w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 
 					// preflight options request
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key, X-Request-ID, traceparent, tracestate, baggage")
 						w.WriteHeader(http.StatusOK)
 						return
 					}
@@ -230,18 +482,67 @@ func (app *Application) metrics(next http.Handler) http.Handler {
 	})
 }
 
-func (app *Application) logRequest(next http.Handler) http.Handler {
+// requestID takes the request id from the X-Request-ID header, so ids of a
+// proxy in front of us are kept, or generates one. The id is echoed in the
+// response and added to every log entry written for the request.
+func (app *Application) requestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
 
-		message := "recived request"
-		properties := map[string]string{
-			"ip":     r.RemoteAddr,
-			"proto":  r.Proto,
-			"method": r.Method,
-			"uri":    r.URL.RequestURI(),
+		if !validRequestID(id) {
+			id = newRequestID()
 		}
-		app.logger.PrintInfo(message, properties)
 
-		next.ServeHTTP(w, r)
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
+// validRequestID only accepts ids that are safe to echo and to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+
+	// crypto/rand never returns an error
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// traceRequest starts the span every handler span is a child of, so log
+// entries of the request share its trace id.
+func (app *Application) traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// continue the trace of the caller, if the request carries one
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		ctx, span := app.config.tracer.Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("http.request_id", app.contextGetRequestID(r)),
+			),
+		)
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
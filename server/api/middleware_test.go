@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/jsonlog"
+)
+
+func TestRequirePermissionHelpers(t *testing.T) {
+	app := &Application{}
+
+	ok := func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	tests := []struct {
+		name        string
+		user        *data.User
+		permissions data.Permissions
+		middleware  func([]string, httprouter.Handle) httprouter.Handle
+		codes       []string
+		want        int
+	}{
+		{"any with one granted", &data.User{ID: 1, Activated: true}, data.Permissions{"movies:read"}, app.requireAnyPermission, []string{"users:admin", "movies:read"}, http.StatusOK},
+		{"any with none granted", &data.User{ID: 1, Activated: true}, data.Permissions{"movies:read"}, app.requireAnyPermission, []string{"users:admin", "roles:admin"}, http.StatusForbidden},
+		{"all with all granted", &data.User{ID: 1, Activated: true}, data.Permissions{"movies:*", "users:admin"}, app.requireAllPermissions, []string{"users:admin", "movies:write"}, http.StatusOK},
+		{"all with one missing", &data.User{ID: 1, Activated: true}, data.Permissions{"movies:write"}, app.requireAllPermissions, []string{"users:admin", "movies:read"}, http.StatusForbidden},
+		{"all with implied permission", &data.User{ID: 1, Activated: true}, data.Permissions{"movies:write"}, app.requireAllPermissions, []string{"movies:read"}, http.StatusOK},
+		{"inactive user", &data.User{ID: 1}, data.Permissions{"*"}, app.requireAnyPermission, []string{"movies:read"}, http.StatusForbidden},
+		{"anonymous user", data.AnonymousUser, data.Permissions{}, app.requireAllPermissions, []string{"movies:read"}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = app.contextSetUser(r, tt.user)
+			r = app.contextSetPermissions(r, tt.permissions)
+
+			rr := httptest.NewRecorder()
+			tt.middleware(tt.codes, ok)(rr, r, nil)
+
+			if rr.Code != tt.want {
+				t.Errorf("got status %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	app := &Application{}
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"generated when missing", "", false},
+		{"kept when valid", "edge-7f3a:42", true},
+		{"replaced when invalid", "bad id\r\nX-Injected: 1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = app.contextGetRequestID(r)
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-ID", tt.header)
+			}
+
+			rr := httptest.NewRecorder()
+			app.requestID(next).ServeHTTP(rr, r)
+
+			got := rr.Header().Get("X-Request-ID")
+			if got == "" || got != seen {
+				t.Fatalf("response id %q does not match context id %q", got, seen)
+			}
+
+			if (got == tt.header) != tt.keep {
+				t.Errorf("got id %q for header %q", got, tt.header)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	mux := httprouter.New()
+	router := routeRecorder{mux}
+
+	app := &Application{}
+
+	router.GET("/v1/healthcheck", func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		w.Write([]byte("ok"))
+	})
+	router.GET("/v1/movies/:id", func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		app.contextSetUser(r, &data.User{ID: 7})
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("movie"))
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		app.logger = jsonlog.New(&buf, jsonlog.LevelInfo)
+		app.logger.SetCorrelation(logCorrelation)
+		app.accessLogger = newAccessLogger(nil, accessLogJSON, []string{"/v1/healthcheck"}, 0, 0)
+
+		handler := app.accessLog(mux)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/movies/42?token=secret", nil))
+
+		var entry struct {
+			UserID     int64          `json:"user_id"`
+			Properties map[string]any `json:"properties"`
+		}
+
+		err := json.Unmarshal(buf.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("expected exactly one entry, got %q: %v", buf.String(), err)
+		}
+
+		if strings.Contains(buf.String(), "secret") {
+			t.Errorf("query string logged: %s", buf.String())
+		}
+
+		if entry.UserID != 7 {
+			t.Errorf("got user id %d, want 7", entry.UserID)
+		}
+
+		want := map[string]any{"route": "/v1/movies/:id", "path": "/v1/movies/42", "status": 201.0, "bytes": 5.0}
+		for k, v := range want {
+			if entry.Properties[k] != v {
+				t.Errorf("got %s %v, want %v", k, entry.Properties[k], v)
+			}
+		}
+	})
+
+	t.Run("combined", func(t *testing.T) {
+		var buf bytes.Buffer
+		app.accessLogger = newAccessLogger(&buf, accessLogCombined, nil, 0, 0)
+
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies/42?token=secret", nil)
+		r.Header.Set("User-Agent", `curl "8"`)
+
+		app.accessLog(mux).ServeHTTP(httptest.NewRecorder(), r)
+
+		line := buf.String()
+		if !strings.HasPrefix(line, "192.0.2.1 - 7 [") || !strings.HasSuffix(line, "] \"GET /v1/movies/42 HTTP/1.1\" 201 5 \"-\" \"curl \\\"8\\\"\"\n") {
+			t.Errorf("unexpected combined line %q", line)
+		}
+	})
+
+	t.Run("route pattern", func(t *testing.T) {
+		tests := []struct {
+			path  string
+			route string
+		}{
+			// a parameter value that is also a literal segment of the path
+			{"/v1/movies/v1", "/v1/movies/:id"},
+			{"/v1/unknown", ""},
+		}
+
+		for _, tt := range tests {
+			var buf bytes.Buffer
+			app.logger = jsonlog.New(&buf, jsonlog.LevelInfo)
+			app.accessLogger = newAccessLogger(nil, accessLogJSON, nil, 0, 0)
+
+			app.accessLog(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			var entry struct {
+				Properties map[string]any `json:"properties"`
+			}
+
+			err := json.Unmarshal(buf.Bytes(), &entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if entry.Properties["route"] != tt.route {
+				t.Errorf("%s: got route %v, want %q", tt.path, entry.Properties["route"], tt.route)
+			}
+		}
+	})
+
+	t.Run("sampling", func(t *testing.T) {
+		l := newAccessLogger(nil, accessLogCombined, nil, 2, 0)
+		now := time.Unix(1700000000, 0)
+
+		got := []bool{l.sampled(now), l.sampled(now), l.sampled(now), l.sampled(now.Add(time.Second))}
+		want := []bool{true, true, false, true}
+
+		if !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
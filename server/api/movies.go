@@ -7,6 +7,7 @@ import (
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/policy"
 	"github.com/mahmoud-shabban/greenlight/internal/validator"
 )
 
@@ -29,11 +30,14 @@ func (app *Application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	user := app.contextGetUser(r)
+
 	movie := data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		CreatedBy: &user.ID,
 	}
 
 	span.AddEvent("validating data")
@@ -134,6 +138,12 @@ func (app *Application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
+
+	span.AddEvent("checking movie write policy")
+	if !app.authorizeMovieWrite(w, r, movie) {
+		return
+	}
+
 	input := struct {
 		Title   *string       `json:"title"`
 		Year    *int64        `json:"year"`
@@ -201,6 +211,23 @@ func (app *Application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	span.AddEvent("query movie with id")
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("checking movie write policy")
+	if !app.authorizeMovieWrite(w, r, movie) {
+		return
+	}
+
 	span.AddEvent("delete db data")
 	err = app.models.Movies.Delete(id)
 	if err != nil {
@@ -273,3 +300,20 @@ func (app *Application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// fmt.Fprintf(w, "%+v\n", input)
 
 }
+
+// authorizeMovieWrite consults the movie policy for the authenticated user and
+// writes the error response itself when access is denied.
+func (app *Application) authorizeMovieWrite(w http.ResponseWriter, r *http.Request, movie *data.Movie) bool {
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !policy.CanModifyMovie(app.contextGetUser(r), permissions, movie) {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
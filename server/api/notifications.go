@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+// notificationPreferences returns the stored preferences of the user, or the
+// defaults when the user never saved any.
+func (app *Application) notificationPreferences(userID int64) (*data.NotificationPreferences, error) {
+	prefs, err := app.models.Notifications.Get(userID)
+	if errors.Is(err, data.ErrRecoredNotFound) {
+		return data.DefaultNotificationPreferences(userID), nil
+	}
+
+	return prefs, err
+}
+
+func (app *Application) showNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "show notification preferences")
+	defer span.End()
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("query notification preferences")
+	prefs, err := app.notificationPreferences(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"notifications": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "update notification preferences")
+	defer span.End()
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("query notification preferences")
+	prefs, err := app.notificationPreferences(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		Genres    []string `json:"genres"`
+		Frequency *string  `json:"frequency"`
+		OptedOut  *bool    `json:"opted_out"`
+	}
+
+	span.AddEvent("read request body")
+	err = app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Genres != nil {
+		prefs.Genres = input.Genres
+	}
+
+	if input.Frequency != nil {
+		prefs.Frequency = *input.Frequency
+	}
+
+	if input.OptedOut != nil {
+		prefs.OptedOut = *input.OptedOut
+	}
+
+	v := validator.New()
+
+	if data.ValidateNotificationPreferences(v, prefs); !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("save notification preferences in database")
+	err = app.models.Notifications.Save(prefs)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"notifications": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unsubscribeHandler serves the links in digest emails. It accepts GET for
+// links opened in a browser and POST for RFC 8058 one-click unsubscribes,
+// both authenticated by the signed token alone.
+func (app *Application) unsubscribeHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "unsubscribe")
+	defer span.End()
+
+	token := r.URL.Query().Get("token")
+
+	v := validator.New()
+
+	v.Check(token != "", "token", "must be provided")
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("verifying unsubscribe token")
+	userID, err := app.unsubscribe.Verify(token)
+	if err != nil {
+		v.AddError("token", "invalid unsubscribe token")
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("opting out of digest emails")
+	err = app.models.Notifications.OptOut(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfoContext(r.Context(), "user unsubscribed from digest emails", map[string]string{
+		"user_id": strconv.FormatInt(userID, 10),
+	})
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "you will no longer receive digest emails"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+var errInvalidOAuthClient = errors.New("invalid oauth client credentials")
+
+// oauthPermissions returns the scopes that the user still holds, so a token
+// never grants more than its user currently has.
+func (app *Application) oauthPermissions(userID int64, scopes []string) (data.Permissions, error) {
+	userPermissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := data.Permissions{}
+	for _, code := range scopes {
+		if userPermissions.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	return permissions, nil
+}
+
+// verifyPKCE checks a code verifier against an S256 code challenge as
+// described in RFC 7636.
+func verifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// readOAuthForm parses the application/x-www-form-urlencoded body that the
+// oauth token, introspection and revocation endpoints receive.
+func (app *Application) readOAuthForm(w http.ResponseWriter, r *http.Request) error {
+	maxBytes := 1_048_576
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	return r.ParseForm()
+}
+
+// authenticateOAuthClient identifies the client with HTTP basic auth or the
+// client_id and client_secret form values. Public clients only send their id.
+func (app *Application) authenticateOAuthClient(r *http.Request) (*data.OAuthClient, error) {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		var err error
+
+		clientID, err = url.QueryUnescape(clientID)
+		if err != nil {
+			return nil, errInvalidOAuthClient
+		}
+
+		secret, err = url.QueryUnescape(secret)
+		if err != nil {
+			return nil, errInvalidOAuthClient
+		}
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := app.models.OAuthClients.GetByClientID(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			return nil, errInvalidOAuthClient
+		default:
+			return nil, err
+		}
+	}
+
+	if client.Confidential && !client.SecretMatches(secret) {
+		return nil, errInvalidOAuthClient
+	}
+
+	if !client.Confidential && secret != "" {
+		return nil, errInvalidOAuthClient
+	}
+
+	return client, nil
+}
+
+func (app *Application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "list oauth clients")
+	defer span.End()
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("query user oauth clients")
+	clients, err := app.models.OAuthClients.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"oauth_clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "create oauth client")
+	defer span.End()
+
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		GrantTypes   []string `json:"grant_types"`
+		Scopes       []string `json:"scopes"`
+		Confidential *bool    `json:"confidential"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	client := &data.OAuthClient{
+		UserID:       app.contextGetUser(r).ID,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		GrantTypes:   input.GrantTypes,
+		Scopes:       input.Scopes,
+		Confidential: true,
+	}
+
+	if input.Confidential != nil {
+		client.Confidential = *input.Confidential
+	}
+
+	if client.RedirectURIs == nil {
+		client.RedirectURIs = []string{}
+	}
+
+	if client.GrantTypes == nil {
+		client.GrantTypes = []string{data.GrantAuthorizationCode}
+	}
+
+	v := validator.New()
+
+	data.ValidateOAuthClient(v, client)
+
+	err = app.validatePermissionCodes(v, "scopes", client.Scopes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("insert oauth client into database")
+	err = app.models.OAuthClients.New(client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", "/v1/users/me/oauth-clients/"+strconv.FormatInt(client.ID, 10))
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusCreated, envelope{"oauth_client": client}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "delete oauth client")
+	defer span.End()
+
+	id, err := app.readIDParam(params)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	span.AddEvent("delete oauth client from database")
+	err = app.models.OAuthClients.DeleteForUser(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "oauth client successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oauthAuthorizeHandler is called by our own frontend once the user consented
+// to the authorization request of a client. It issues an authorization code
+// and returns the uri the user agent must be redirected to.
+func (app *Application) oauthAuthorizeHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "oauth authorize")
+	defer span.End()
+
+	var input struct {
+		ResponseType        string `json:"response_type"`
+		ClientID            string `json:"client_id"`
+		RedirectURI         string `json:"redirect_uri"`
+		Scope               string `json:"scope"`
+		State               string `json:"state"`
+		CodeChallenge       string `json:"code_challenge"`
+		CodeChallengeMethod string `json:"code_challenge_method"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.ResponseType == "code", "response_type", "must be code")
+	v.Check(input.ClientID != "", "client_id", "must be provided")
+	v.Check(input.CodeChallengeMethod == "S256", "code_challenge_method", "must be S256")
+	v.Check(len(input.CodeChallenge) >= 43 && len(input.CodeChallenge) <= 128, "code_challenge", "must be between 43 and 128 bytes long")
+	v.Check(len(input.State) <= 500, "state", "must not be more than 500 bytes long")
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("query oauth client")
+	client, err := app.models.OAuthClients.GetByClientID(input.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			v.AddError("client_id", "unknown client")
+			app.faildValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v.Check(client.AllowsGrant(data.GrantAuthorizationCode), "client_id", "client is not allowed to use the authorization_code grant")
+
+	redirectURI := input.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+
+	v.Check(client.AllowsRedirectURI(redirectURI), "redirect_uri", "must be one of the redirect uris registered for the client")
+
+	scopes := data.ParseOAuthScope(input.Scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+
+	userPermissions, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, code := range scopes {
+		v.Check(data.Permissions(client.Scopes).Include(code), "scope", "must only contain scopes registered for the client")
+		v.Check(userPermissions.Include(code), "scope", "must be a subset of your own permissions")
+	}
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("issuing authorization code")
+	user := app.contextGetUser(r)
+
+	code, err := app.models.Tokens.NewOAuthCode(user.ID, app.config.oauth.codeTTL, client.ClientID, scopes, redirectURI, input.CodeChallenge)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	redirectTo, err := url.Parse(redirectURI)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	query := redirectTo.Query()
+	query.Set("code", code.Plaintext)
+	if input.State != "" {
+		query.Set("state", input.State)
+	}
+	redirectTo.RawQuery = query.Encode()
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusCreated, envelope{"redirect_to": redirectTo.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) oauthTokenHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "oauth token")
+	defer span.End()
+
+	span.AddEvent("reading request data")
+	err := app.readOAuthForm(w, r)
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the request body must be a valid form")
+		return
+	}
+
+	span.AddEvent("authenticating client")
+	client, err := app.authenticateOAuthClient(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidOAuthClient):
+			app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	if !validator.In(grantType, data.OAuthGrantTypes...) {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or client_credentials")
+		return
+	}
+
+	if !client.AllowsGrant(grantType) {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unauthorized_client", "the client is not allowed to use this grant type")
+		return
+	}
+
+	var userID int64
+	var scopes []string
+
+	switch grantType {
+	case data.GrantAuthorizationCode:
+		span.AddEvent("exchanging authorization code")
+		code, err := app.models.Tokens.ConsumeOAuthCode(r.PostForm.Get("code"))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecoredNotFound):
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid, expired or already used authorization code")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if code.ClientID != client.ClientID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the authorization code was issued to another client or redirect uri")
+			return
+		}
+
+		if !verifyPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid code_verifier")
+			return
+		}
+
+		userID, scopes = code.UserID, code.OAuthScopes
+
+	case data.GrantClientCredentials:
+		// machine clients act as the user who registered them
+		scopes = data.ParseOAuthScope(r.PostForm.Get("scope"))
+		if len(scopes) == 0 {
+			scopes = client.Scopes
+		}
+
+		for _, code := range scopes {
+			if !data.Permissions(client.Scopes).Include(code) {
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the requested scope is not registered for the client")
+				return
+			}
+		}
+
+		userID = client.UserID
+	}
+
+	span.AddEvent("query user")
+	user, err := app.models.Users.Get(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user.Locked || !user.Activated {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the user account is locked or not activated")
+		return
+	}
+
+	span.AddEvent("issuing access token")
+	ttl := app.config.oauth.accessTokenTTL
+
+	token, err := app.models.Tokens.NewOAuthAccess(user.ID, ttl, client.ClientID, scopes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oauthIntrospectHandler implements RFC 7662. Confidential clients can only
+// introspect the tokens issued to themselves.
+func (app *Application) oauthIntrospectHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "oauth introspect")
+	defer span.End()
+
+	span.AddEvent("reading request data")
+	err := app.readOAuthForm(w, r)
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the request body must be a valid form")
+		return
+	}
+
+	span.AddEvent("authenticating client")
+	client, err := app.authenticateOAuthClient(r)
+	if err == nil && !client.Confidential {
+		err = errInvalidOAuthClient
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidOAuthClient):
+			app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	inactive := envelope{"active": false}
+
+	tokenPlaintext := r.PostForm.Get("token")
+
+	v := validator.New()
+
+	if data.ValidateOAuthAccessTokenPlaintext(v, tokenPlaintext); !v.Valid() {
+		err = app.writeJson(w, http.StatusOK, inactive, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("query token")
+	token, err := app.models.Tokens.GetOAuthAccess(tokenPlaintext)
+	if err != nil && !errors.Is(err, data.ErrRecoredNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err != nil || token.ClientID != client.ClientID {
+		err = app.writeJson(w, http.StatusOK, inactive, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user.Locked {
+		err = app.writeJson(w, http.StatusOK, inactive, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	permissions, err := app.oauthPermissions(user.ID, token.OAuthScopes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{
+		"active":     true,
+		"scope":      strings.Join(permissions, " "),
+		"client_id":  token.ClientID,
+		"sub":        strconv.FormatInt(user.ID, 10),
+		"token_type": "Bearer",
+		"exp":        token.Expiry.Unix(),
+		"iat":        token.CreatedAt.Unix(),
+	}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oauthRevokeHandler implements RFC 7009, it responds with 200 even when the
+// token is unknown so clients can not probe for valid tokens.
+func (app *Application) oauthRevokeHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "oauth revoke")
+	defer span.End()
+
+	span.AddEvent("reading request data")
+	err := app.readOAuthForm(w, r)
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the request body must be a valid form")
+		return
+	}
+
+	span.AddEvent("authenticating client")
+	client, err := app.authenticateOAuthClient(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidOAuthClient):
+			app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	tokenPlaintext := r.PostForm.Get("token")
+
+	if data.IsOAuthAccessToken(tokenPlaintext) {
+		span.AddEvent("deleting token")
+		err = app.models.Tokens.DeleteOAuthForClient(tokenPlaintext, client.ClientID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
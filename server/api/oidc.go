@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/oidc"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+// oidcStates keeps the nonce and PKCE verifier of pending OpenID Connect
+// logins between the redirect to the provider and the callback.
+type oidcStates struct {
+	mu      sync.Mutex
+	pending map[string]oidcLogin
+	ttl     time.Duration
+}
+
+type oidcLogin struct {
+	nonce     string
+	verifier  string
+	createdAt time.Time
+}
+
+func newOIDCStates(ttl time.Duration) *oidcStates {
+	s := &oidcStates{
+		pending: make(map[string]oidcLogin),
+		ttl:     ttl,
+	}
+
+	// go routine for abandoned logins cleaning
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			s.mu.Lock()
+
+			for state, login := range s.pending {
+				if time.Since(login.createdAt) > s.ttl {
+					delete(s.pending, state)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}()
+
+	return s
+}
+
+func (s *oidcStates) add(state string, login oidcLogin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending[state] = login
+}
+
+// take removes the pending login, so every state can only be used once.
+func (s *oidcStates) take(state string) (oidcLogin, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, found := s.pending[state]
+	delete(s.pending, state)
+
+	if !found || time.Since(login.createdAt) > s.ttl {
+		return oidcLogin{}, false
+	}
+
+	return login, true
+}
+
+func (app *Application) oidcLoginHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "oidc login")
+	defer span.End()
+
+	if app.oidcProvider == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	span.AddEvent("generating state, nonce and pkce verifier")
+	state, err := oidc.RandomString(24)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	nonce, err := oidc.RandomString(24)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.oidcStates.add(state, oidcLogin{
+		nonce:     nonce,
+		verifier:  verifier,
+		createdAt: time.Now(),
+	})
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{
+		"authorization_url": app.oidcProvider.AuthCodeURL(state, nonce, challenge),
+		"state":             state,
+	}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx, span := app.config.tracer.Start(r.Context(), "oidc callback")
+	defer span.End()
+
+	if app.oidcProvider == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(input.State != "", "state", "must be provided")
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	login, ok := app.oidcStates.take(input.State)
+	if !ok {
+		v.AddError("state", "unknown or expired login state")
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("exchanging code at the identity provider")
+	idToken, err := app.oidcProvider.Exchange(ctx, input.Code, login.verifier, login.nonce)
+	if err != nil {
+		app.logger.PrintInfoContext(r.Context(), "oidc login failed", map[string]string{"error": err.Error()})
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	span.AddEvent("resolving user for identity")
+	user, err := app.userForIdentity(idToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnverifiedEmail):
+			v.AddError("email", "the identity provider did not verify the email address")
+			app.faildValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Locked {
+		app.lockedAccountResponse(w, r)
+		return
+	}
+
+	app.completeLogin(ctx, w, r, user)
+}
+
+var errUnverifiedEmail = errors.New("unverified email")
+
+// userForIdentity returns the user linked to the external identity. Unknown
+// identities are linked to the user with the same verified email, or a new
+// user is provisioned with the configured default role.
+func (app *Application) userForIdentity(idToken *oidc.IDToken) (*data.User, error) {
+	user, err := app.models.Identities.GetUser(idToken.Issuer, idToken.Subject)
+	if err == nil {
+		if idToken.Email != "" {
+			err = app.models.Identities.UpdateEmail(idToken.Issuer, idToken.Subject, idToken.Email)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return user, nil
+	}
+
+	if !errors.Is(err, data.ErrRecoredNotFound) {
+		return nil, err
+	}
+
+	// linking by email is only safe when the provider vouches for it
+	if idToken.Email == "" || !idToken.EmailVerified {
+		return nil, errUnverifiedEmail
+	}
+
+	identity := &data.Identity{
+		Issuer:  idToken.Issuer,
+		Subject: idToken.Subject,
+		Email:   idToken.Email,
+	}
+
+	user, err = app.models.Users.GetByEmail(idToken.Email)
+	switch {
+	case err == nil:
+		identity.UserID = user.ID
+
+		err = app.models.Identities.Insert(identity)
+		if err != nil {
+			return nil, err
+		}
+	case errors.Is(err, data.ErrRecoredNotFound):
+		user, err = app.provisionOIDCUser(idToken, identity)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	app.logger.PrintInfo("external identity linked", map[string]string{
+		"user_id": strconv.FormatInt(user.ID, 10),
+		"issuer":  identity.Issuer,
+		"subject": identity.Subject,
+	})
+
+	return user, nil
+}
+
+// provisionOIDCUser creates an activated user for a first login through the
+// identity provider and links identity to it. The user gets a random password
+// it never learns, a password can be set later through the password reset
+// flow.
+func (app *Application) provisionOIDCUser(idToken *oidc.IDToken, identity *data.Identity) (*data.User, error) {
+	name := idToken.Name
+	if name == "" {
+		name = idToken.Email
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     idToken.Email,
+		Activated: true,
+	}
+
+	password, err := oidc.RandomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Identities.Provision(user, app.config.oidc.defaultRole, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.PrintInfo("user provisioned from identity provider", map[string]string{
+		"user_id": strconv.FormatInt(user.ID, 10),
+		"issuer":  idToken.Issuer,
+		"role":    app.config.oidc.defaultRole,
+	})
+
+	return user, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// startOutboxWorkers starts the workers delivering emails from the outbox.
+// They stop once ctx is cancelled, after finishing the batch at hand.
+func (app *Application) startOutboxWorkers(ctx context.Context) {
+	for i := 0; i < app.config.outbox.workers; i++ {
+		app.wg.Add(1)
+
+		go func() {
+			defer app.wg.Done()
+
+			app.runOutboxWorker(ctx)
+		}()
+	}
+
+	app.logger.PrintInfo("email outbox workers started", map[string]string{
+		"workers": strconv.Itoa(app.config.outbox.workers),
+	})
+}
+
+func (app *Application) runOutboxWorker(ctx context.Context) {
+	for {
+		// keep going without sleeping while there is a backlog
+		claimed := app.deliverOutboxBatch()
+
+		if claimed == app.config.outbox.batchSize {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(app.config.outbox.pollInterval):
+		}
+	}
+}
+
+// deliverOutboxBatch claims a batch of due emails, sends them and records the
+// outcome. It returns the number of claimed emails.
+func (app *Application) deliverOutboxBatch() int {
+	emails, err := app.models.Outbox.Claim(app.config.outbox.batchSize, app.config.outbox.lease)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return 0
+	}
+
+	for _, email := range emails {
+		app.deliverOutboxEmail(email)
+	}
+
+	return len(emails)
+}
+
+func (app *Application) deliverOutboxEmail(email *data.OutboxEmail) {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.PrintError(fmt.Errorf("%s", err), nil)
+		}
+	}()
+
+	sendErr := app.mailer.Send(email.Recipient, email.Locale, email.Template, email.Data)
+	if sendErr == nil {
+		err := app.models.Outbox.MarkSent(email)
+		if err != nil {
+			app.logOutboxUpdateError(email, err)
+		}
+		return
+	}
+
+	dead := email.Attempts >= app.config.outbox.maxAttempts
+	nextAttempt := time.Now().Add(app.outboxBackoff(email.Attempts))
+
+	err := app.models.Outbox.MarkFailed(email, sendErr, nextAttempt, dead)
+	if err != nil {
+		app.logOutboxUpdateError(email, err)
+		return
+	}
+
+	properties := map[string]string{
+		"email_id": strconv.FormatInt(email.ID, 10),
+		"template": email.Template,
+		"attempts": strconv.Itoa(email.Attempts),
+		"error":    sendErr.Error(),
+	}
+
+	if dead {
+		app.logger.PrintError(fmt.Errorf("email moved to dead-letter state"), properties)
+		return
+	}
+
+	app.logger.PrintWarn("email delivery failed, will retry", properties)
+}
+
+// logOutboxUpdateError logs a failure to record the outcome of a delivery. A
+// lost lease means the delivery took longer than the lease and another
+// worker claimed the email, which may then be delivered twice.
+func (app *Application) logOutboxUpdateError(email *data.OutboxEmail, err error) {
+	if errors.Is(err, data.ErrLeaseLost) {
+		app.logger.PrintWarn("outbox lease lost, the email was claimed by another worker", map[string]string{
+			"email_id": strconv.FormatInt(email.ID, 10),
+			"template": email.Template,
+		})
+		return
+	}
+
+	app.logger.PrintError(err, nil)
+}
+
+// outboxBackoff returns the delay before the next delivery attempt, doubling
+// with every failed attempt up to the configured maximum.
+func (app *Application) outboxBackoff(attempts int) time.Duration {
+	cfg := app.config.outbox
+
+	backoff := time.Duration(float64(cfg.backoffBase) * math.Pow(2, float64(attempts-1)))
+	if backoff > cfg.backoffMax || backoff <= 0 {
+		backoff = cfg.backoffMax
+	}
+
+	return backoff
+}
+
+func (app *Application) readOutboxEmailParam(w http.ResponseWriter, r *http.Request, params httprouter.Params) (*data.OutboxEmail, bool) {
+	id, err := app.readIDParam(params)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	email, err := app.models.Outbox.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return email, true
+}
+
+func (app *Application) adminListEmailsHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin list emails")
+	defer span.End()
+
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	span.AddEvent("reading url query string and validating")
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+
+	input.Filters.SortSafelist = []string{"id", "-id", "created_at", "-created_at", "next_attempt_at", "-next_attempt_at"}
+
+	if input.Status != "" {
+		v.Check(validator.In(input.Status, data.OutboxStatuses...), "status", "must be pending, sending, sent or dead")
+	}
+
+	data.ValidateFilters(v, input.Filters)
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("getting emails")
+	emails, meta, err := app.models.Outbox.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"metadata": meta, "emails": emails}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) adminShowEmailHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin show email")
+	defer span.End()
+
+	span.AddEvent("query email with id")
+	email, ok := app.readOutboxEmailParam(w, r, params)
+	if !ok {
+		return
+	}
+
+	span.AddEvent("sending response")
+	err := app.writeJson(w, http.StatusOK, envelope{"email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) adminRequeueEmailHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "admin requeue email")
+	defer span.End()
+
+	span.AddEvent("query email with id")
+	email, ok := app.readOutboxEmailParam(w, r, params)
+	if !ok {
+		return
+	}
+
+	if !email.Failed() {
+		app.emailNotFailedResponse(w, r)
+		return
+	}
+
+	previousStatus := email.Status
+	attempts := email.Attempts
+
+	span.AddEvent("requeue email in database")
+	err := app.models.Outbox.Requeue(email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	actor := app.contextGetUser(r)
+
+	app.logger.PrintAuditContext(r.Context(), "admin action", map[string]string{
+		"action":          "requeue_email",
+		"actor_id":        strconv.FormatInt(actor.ID, 10),
+		"email_id":        strconv.FormatInt(email.ID, 10),
+		"previous_status": previousStatus,
+		"attempts":        strconv.Itoa(attempts),
+		"ip":              realip.FromRequest(r),
+	})
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
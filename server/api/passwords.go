@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+// revokeUserSessions deletes every authentication and refresh token of the
+// user, it is called whenever the password changes.
+func (app *Application) revokeUserSessions(userID int64) error {
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh, data.ScopeMFA} {
+		err := app.models.Tokens.DeleteAllForUser(userID, scope)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (app *Application) changePasswordHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "change password")
+	defer span.End()
+
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	span.AddEvent("reading request data")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("query user")
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("compare current password")
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	span.AddEvent("validating new password")
+	v := validator.New()
+
+	if app.passwordPolicy.Validate(v, input.NewPassword, user.Name, user.Email); !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(input.NewPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("update user in database")
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("revoking sessions")
+	err = app.revokeUserSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "your password was successfully changed, please log in again"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx, span := app.config.tracer.Start(r.Context(), "create password reset token")
+	defer span.End()
+
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the response is the same whether the email is registered or not so the
+	// endpoint can not be used to enumerate accounts
+	message := envelope{"message": "if the email address is registered, an email will be sent to it containing password reset instructions"}
+
+	span.AddEvent("query user")
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			err = app.writeJson(w, http.StatusAccepted, message, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated || user.Locked {
+		err = app.writeJson(w, http.StatusAccepted, message, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("create password reset token")
+	token, err := app.models.Tokens.New(ctx, user.ID, 45*time.Minute, data.ScopePasswordReset, app.config.tracer)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Outbox.Enqueue(user.Email, user.Language, "token_password_reset.tmpl.html", map[string]any{
+		"passwordResetToken": token.Plaintext,
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusAccepted, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) resetPasswordHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "reset password")
+	defer span.End()
+
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("query token owner")
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.faildValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if app.passwordPolicy.Validate(v, input.Password, user.Name, user.Email); !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("update user in database")
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("revoking reset tokens and sessions")
+	err = app.models.Tokens.DeleteAllForUser(user.ID, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.revokeUserSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// rehashPassword replaces the stored hash of the user with one produced by
+// the current hasher. Failures are logged only, the login itself succeeded.
+func (app *Application) rehashPassword(user *data.User, plainText string) {
+	err := user.Password.Set(plainText)
+	if err == nil {
+		err = app.models.Users.UpdatePasswordHash(user)
+	}
+
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"user_id": strconv.FormatInt(user.ID, 10)})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/policy"
 )
 
 func (app *Application) routerNotFoundHandler(w http.ResponseWriter, r *http.Request) {
@@ -13,26 +14,90 @@ func (app *Application) routerNotFoundHandler(w http.ResponseWriter, r *http.Req
 
 func (app *Application) routes() http.Handler {
 
-	router := httprouter.Router{
+	mux := &httprouter.Router{
 		RedirectTrailingSlash:  true,
 		HandleMethodNotAllowed: true,
 		NotFound:               http.HandlerFunc(app.routerNotFoundHandler),
 		MethodNotAllowed:       http.HandlerFunc(app.methodNotAllowedResponse),
 	}
 
+	// routes are registered through the recorder, so the access log knows
+	// the pattern of the route a request matched
+	router := routeRecorder{mux}
+
 	router.GET("/v1/healthcheck", app.healthCheckeHandler)
 
-	router.POST("/v1/movies", app.requirePermissions("movies:write", app.createMovieHandler))
+	router.POST("/v1/movies", app.requireAnyPermission(policy.MovieWriters, app.createMovieHandler))
 	router.GET("/v1/movies", app.requirePermissions("movies:read", app.listMoviesHandler))
 	router.GET("/v1/movies/:id", app.requirePermissions("movies:read", app.showMovieHandler))
-	router.PATCH("/v1/movies/:id", app.requirePermissions("movies:write", app.updateMovieHandler))
-	router.DELETE("/v1/movies/:id", app.requirePermissions("movies:write", app.deleteMovieHandler))
+	router.PATCH("/v1/movies/:id", app.requireAnyPermission(policy.MovieWriters, app.updateMovieHandler))
+	router.DELETE("/v1/movies/:id", app.requireAnyPermission(policy.MovieWriters, app.deleteMovieHandler))
 
 	router.POST("/v1/users", app.registerUserHandler)
 	router.PUT("/v1/users/activated", app.activateUserHandler)
+	router.PUT("/v1/users/password", app.resetPasswordHandler)
+	router.PUT("/v1/users/me/password", app.requireInteractiveUser(app.changePasswordHandler))
+	router.GET("/v1/users/me/sessions", app.requireInteractiveUser(app.listSessionsHandler))
+	router.DELETE("/v1/users/me/sessions/:id", app.requireInteractiveUser(app.deleteSessionHandler))
+	router.GET("/v1/users/me/api-keys", app.requireInteractiveUser(app.listAPIKeysHandler))
+	router.POST("/v1/users/me/api-keys", app.requireInteractiveUser(app.createAPIKeyHandler))
+	router.GET("/v1/users/me/api-keys/:id", app.requireInteractiveUser(app.showAPIKeyHandler))
+	router.PATCH("/v1/users/me/api-keys/:id", app.requireInteractiveUser(app.updateAPIKeyHandler))
+	router.DELETE("/v1/users/me/api-keys/:id", app.requireInteractiveUser(app.deleteAPIKeyHandler))
+
+	router.GET("/v1/users/me/notifications", app.requiredActivatedUser(app.showNotificationPreferencesHandler))
+	router.PATCH("/v1/users/me/notifications", app.requiredActivatedUser(app.updateNotificationPreferencesHandler))
+	router.GET("/v1/notifications/unsubscribe", app.unsubscribeHandler)
+	router.POST("/v1/notifications/unsubscribe", app.unsubscribeHandler)
+
+	router.GET("/v1/users/me/oauth-clients", app.requireInteractiveUser(app.listOAuthClientsHandler))
+	router.POST("/v1/users/me/oauth-clients", app.requireInteractiveUser(app.createOAuthClientHandler))
+	router.DELETE("/v1/users/me/oauth-clients/:id", app.requireInteractiveUser(app.deleteOAuthClientHandler))
+
+	router.POST("/v1/oidc/login", app.oidcLoginHandler)
+	router.POST("/v1/oidc/callback", app.oidcCallbackHandler)
+
+	router.POST("/v1/oauth/authorize", app.requireInteractiveUser(app.oauthAuthorizeHandler))
+	router.POST("/v1/oauth/token", app.oauthTokenHandler)
+	router.POST("/v1/oauth/introspect", app.oauthIntrospectHandler)
+	router.POST("/v1/oauth/revoke", app.oauthRevokeHandler)
+
+	router.POST("/v1/users/me/2fa/totp", app.requireInteractiveUser(app.enrolTOTPHandler))
+	router.POST("/v1/users/me/2fa/totp/confirm", app.requireInteractiveUser(app.confirmTOTPHandler))
+	router.DELETE("/v1/users/me/2fa/totp", app.requireInteractiveUser(app.disableTOTPHandler))
+	router.POST("/v1/users/me/2fa/recovery-codes", app.requireInteractiveUser(app.regenerateRecoveryCodesHandler))
+
+	router.GET("/v1/roles", app.requirePermissions("roles:admin", app.listRolesHandler))
+	router.POST("/v1/roles", app.requirePermissions("roles:admin", app.createRoleHandler))
+	router.GET("/v1/roles/:id", app.requirePermissions("roles:admin", app.showRoleHandler))
+	router.PATCH("/v1/roles/:id", app.requirePermissions("roles:admin", app.updateRoleHandler))
+	router.DELETE("/v1/roles/:id", app.requirePermissions("roles:admin", app.deleteRoleHandler))
+	router.POST("/v1/roles/:id/users", app.requirePermissions("roles:admin", app.assignRoleHandler))
+	router.DELETE("/v1/roles/:id/users/:user_id", app.requirePermissions("roles:admin", app.unassignRoleHandler))
+
+	router.GET("/v1/admin/users", app.requirePermissions("users:admin", app.adminListUsersHandler))
+	router.GET("/v1/admin/users/:id", app.requirePermissions("users:admin", app.adminShowUserHandler))
+	router.PATCH("/v1/admin/users/:id", app.requirePermissions("users:admin", app.adminUpdateUserHandler))
+	router.POST("/v1/admin/users/:id/permissions", app.requirePermissions("users:admin", app.adminGrantPermissionsHandler))
+	router.DELETE("/v1/admin/users/:id/permissions/:code", app.requirePermissions("users:admin", app.adminRevokePermissionHandler))
+
+	router.GET("/v1/admin/emails/outbox", app.requirePermissions("emails:admin", app.adminListEmailsHandler))
+	router.GET("/v1/admin/emails/outbox/:id", app.requirePermissions("emails:admin", app.adminShowEmailHandler))
+	router.POST("/v1/admin/emails/outbox/:id/requeue", app.requirePermissions("emails:admin", app.adminRequeueEmailHandler))
+	router.GET("/v1/admin/emails/templates", app.requirePermissions("emails:admin", app.adminListEmailTemplatesHandler))
+	router.GET("/v1/admin/emails/templates/:name/preview", app.requirePermissions("emails:admin", app.adminPreviewEmailTemplateHandler))
+	router.POST("/v1/admin/emails/templates/:name/send-test", app.requirePermissions("emails:admin", app.adminSendTestEmailHandler))
+
+	router.GET("/v1/admin/log-level", app.requirePermissions("logs:admin", app.adminShowLogLevelHandler))
+	router.PUT("/v1/admin/log-level", app.requirePermissions("logs:admin", app.adminUpdateLogLevelHandler))
 
 	router.POST("/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.POST("/v1/tokens/authentication/mfa", app.createMFAAuthenticationTokenHandler)
+	router.POST("/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+	router.POST("/v1/tokens/magic-link/consume", app.consumeMagicLinkTokenHandler)
+	router.POST("/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.POST("/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
 
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
-	return app.logRequest(app.metrics(app.recoverPanic(app.rateLimit(app.authenticate(app.enableCORS(&router))))))
+	return app.requestID(app.traceRequest(app.accessLog(app.metrics(app.recoverPanic(app.rateLimit(app.authenticate(app.enableCORS(mux))))))))
 }
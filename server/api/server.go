@@ -23,6 +23,10 @@ func (app *Application) serve() error {
 		ErrorLog:     log.New(app.logger, "", 0),
 	}
 
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	app.startOutboxWorkers(jobsCtx)
+	app.startDigestJob(jobsCtx)
+
 	shutdownError := make(chan error)
 	go func() {
 		quit := make(chan os.Signal, 1)
@@ -47,8 +51,23 @@ func (app *Application) serve() error {
 
 		app.logger.PrintInfo("completing background tasks", nil)
 
+		stopJobs()
+
 		app.wg.Wait()
 
+		// spans of the last requests and background tasks are still batched
+		if app.tracerProvider != nil {
+			app.logger.PrintInfo("flushing traces", nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err = app.tracerProvider.Shutdown(ctx)
+			if err != nil {
+				app.logger.PrintWarn("flushing traces failed", map[string]string{"error": err.Error()})
+			}
+		}
+
 		shutdownError <- nil
 	}()
 
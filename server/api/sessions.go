@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+)
+
+// listSessionsHandler and deleteSessionHandler work on the stored
+// authentication tokens, which only exist in opaque token mode.
+func (app *Application) listSessionsHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "list sessions")
+	defer span.End()
+
+	if app.config.auth.tokenMode == "jwt" {
+		app.sessionsUnavailableResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("query user sessions")
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) deleteSessionHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "delete session")
+	defer span.End()
+
+	if app.config.auth.tokenMode == "jwt" {
+		app.sessionsUnavailableResponse(w, r)
+		return
+	}
+
+	id, err := app.readIDParam(params)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("delete session from database")
+	err = app.models.Tokens.DeleteSessionForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "session deleted successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
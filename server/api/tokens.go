@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/jwt"
 	"github.com/mahmoud-shabban/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (app *Application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -38,11 +43,26 @@ func (app *Application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	span.AddEvent("checking client ip throttle")
+	if retryAfter, blocked := app.loginThrottle.blocked(realip.FromRequest(r)); blocked {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
 	span.AddEvent("query user")
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecoredNotFound):
+			// unknown emails pay the same password hashing cost as known ones
+			data.SimulatePasswordMatch(input.Password)
+
+			err = app.recordLoginFailure(r, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -51,6 +71,21 @@ func (app *Application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// a blocked account gets the same response, after the same hashing cost,
+	// as an unknown email, so the lockout does not reveal registered emails
+	if _, blocked := app.loginBlockedFor(user); blocked {
+		data.SimulatePasswordMatch(input.Password)
+
+		err = app.recordLoginFailure(r, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
 	span.AddEvent("compare passwords")
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
@@ -59,20 +94,332 @@ func (app *Application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if !match {
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	span.AddEvent("generating and saving new authentication token")
-	token, err := app.models.Tokens.New(ctx, user.ID, 24*time.Hour, data.ScopeAuthentication, app.config.tracer)
+	if user.Password.NeedsRehash() {
+		span.AddEvent("upgrading password hash")
+		app.rehashPassword(user, input.Password)
+	}
+
+	if user.Locked {
+		app.lockedAccountResponse(w, r)
+		return
+	}
+
+	app.completeLogin(ctx, w, r, user)
+}
+
+// completeLogin is called once the first factor of the user was verified. It
+// responds with an mfa challenge when two-factor authentication is enabled
+// and with new session tokens otherwise. Failed logins are only reset once
+// the login fully succeeded, so the lockout also covers the second factor.
+func (app *Application) completeLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, user *data.User) {
+	span := trace.SpanFromContext(ctx)
+
+	span.AddEvent("checking two-factor authentication")
+	mfaEnabled, err := app.models.TOTP.Enabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if mfaEnabled {
+		challenge, err := app.models.Tokens.New(ctx, user.ID, 5*time.Minute, data.ScopeMFA, app.config.tracer)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		span.AddEvent("sending mfa challenge")
+		err = app.writeJson(w, http.StatusAccepted, envelope{"mfa_required": true, "mfa_token": challenge}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.FailedLoginAttempts > 0 {
+		err = app.models.Users.ResetLoginFailures(user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	span.AddEvent("generating and saving new authentication and refresh tokens")
+	family, err := app.models.Tokens.NewFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueSessionTokens(ctx, w, r, user.ID, family)
+}
+
+// createMFAAuthenticationTokenHandler is the second step of the login for
+// users with two-factor authentication, it exchanges the challenge token
+// returned by createAuthenticationTokenHandler and a totp or recovery code
+// for the real tokens.
+func (app *Application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+
+	ctx, span := app.config.tracer.Start(r.Context(), "create mfa auth token")
+	defer span.End()
+
+	var input struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	span.AddEvent("reading body")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("validation")
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.MFAToken)
+
+	switch {
+	case input.Code != "":
+		data.ValidateTOTPCode(v, input.Code)
+	default:
+		data.ValidateRecoveryCode(v, input.RecoveryCode)
+	}
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("query challenge owner")
+	user, err := app.models.Users.GetForToken(data.ScopeMFA, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.invalidMFACodeResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if retryAfter, blocked := app.loginBlockedFor(user); blocked {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	span.AddEvent("verifying second factor")
+	ok, err := app.verifySecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.invalidMFACodeResponse(w, r)
+		return
+	}
+
+	if user.FailedLoginAttempts > 0 {
+		err = app.models.Users.ResetLoginFailures(user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if user.Locked {
+		app.lockedAccountResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(user.ID, data.ScopeMFA)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("generating and saving new authentication and refresh tokens")
+	family, err := app.models.Tokens.NewFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueSessionTokens(ctx, w, r, user.ID, family)
+}
+
+func (app *Application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+
+	ctx, span := app.config.tracer.Start(r.Context(), "refresh auth token")
+	defer span.End()
+
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	span.AddEvent("reading body")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("validation")
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("query refresh token")
+	token, err := app.models.Tokens.GetRefresh(input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("rotating refresh token")
+	if token.UsedAt == nil {
+		err = app.models.Tokens.ConsumeRefresh(token)
+	} else {
+		err = data.ErrRecoredNotFound
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			// an already used refresh token was replayed, the whole chain
+			// is considered compromised and gets revoked.
+			span.AddEvent("refresh token reuse detected, revoking family")
+			app.logger.PrintInfoContext(r.Context(), "refresh token reuse detected", map[string]string{
+				"user_id": strconv.FormatInt(token.UserID, 10),
+				"ip":      realip.FromRequest(r),
+			})
+
+			err = app.models.Tokens.DeleteFamily(token.Family)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("checking token owner")
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Locked {
+		app.lockedAccountResponse(w, r)
+		return
+	}
+
+	span.AddEvent("revoking previous authentication tokens of the family")
+	err = app.models.Tokens.DeleteFamily(token.Family, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	span.AddEvent("sending response")
-	err = app.writeJson(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	app.issueSessionTokens(ctx, w, r, token.UserID, token.Family)
+}
+
+// issueSessionTokens creates a new authentication and refresh token pair in
+// the given family and writes them to the response.
+func (app *Application) issueSessionTokens(ctx context.Context, w http.ResponseWriter, r *http.Request, userID int64, family string) {
+	ip := realip.FromRequest(r)
+
+	var token *data.Token
+	var err error
+
+	switch app.config.auth.tokenMode {
+	case "jwt":
+		token, err = app.newJWTAccessToken(userID)
+	default:
+		token, err = app.models.Tokens.NewSession(ctx, userID, app.config.auth.accessTokenTTL, family, ip, r.UserAgent(), app.config.tracer)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	refreshToken, err := app.models.Tokens.NewRefresh(ctx, userID, app.config.auth.refreshTokenTTL, family, ip, r.UserAgent(), app.config.tracer)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// newJWTAccessToken signs a stateless access token carrying everything the
+// authenticate middleware needs, so it is never stored in the database.
+func (app *Application) newJWTAccessToken(userID int64) (*data.Token, error) {
+	user, err := app.models.Users.Get(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
 	}
+
+	claims := jwt.Claims{
+		Subject:     strconv.FormatInt(user.ID, 10),
+		Activated:   user.Activated,
+		Permissions: permissions,
+	}
+
+	signed, err := app.jwtKeys.Sign(claims, app.config.auth.accessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: signed,
+		UserID:    user.ID,
+		Expiry:    time.Now().Add(app.config.auth.accessTokenTTL),
+		Scope:     data.ScopeAuthentication,
+	}, nil
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/totp"
+	"github.com/mahmoud-shabban/greenlight/internal/validator"
+)
+
+// verifySecondFactor checks a totp code, or a recovery code when code is
+// empty. Both can only be used once.
+func (app *Application) verifySecondFactor(userID int64, code, recoveryCode string) (bool, error) {
+	if code == "" {
+		err := app.models.TOTP.UseRecoveryCode(userID, recoveryCode)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecoredNotFound):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+
+		return true, nil
+	}
+
+	t, err := app.models.TOTP.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	if !t.Confirmed() {
+		return false, nil
+	}
+
+	step, ok := totp.Validate(t.Secret, code, time.Now(), 1, t.LastUsedStep)
+	if !ok {
+		return false, nil
+	}
+
+	err = app.models.TOTP.UseStep(userID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (app *Application) enrolTOTPHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "enrol totp")
+	defer span.End()
+
+	span.AddEvent("query user")
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("generating totp secret")
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Enrol(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v := validator.New()
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.faildValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusCreated, envelope{"totp": map[string]string{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(app.config.auth.totpIssuer, user.Email, secret),
+	}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "confirm totp")
+	defer span.End()
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("query pending enrolment")
+	t, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecoredNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if t.Confirmed() {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	step, ok := totp.Validate(t.Secret, input.Code, time.Now(), 1, t.LastUsedStep)
+	if !ok {
+		v.AddError("code", "invalid or expired code")
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	span.AddEvent("confirming enrolment")
+	err = app.models.TOTP.Confirm(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	span.AddEvent("generating recovery codes")
+	codes, err := app.models.TOTP.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) disableTOTPHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "disable totp")
+	defer span.End()
+
+	var input struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	switch {
+	case input.Code != "":
+		data.ValidateTOTPCode(v, input.Code)
+	default:
+		data.ValidateRecoveryCode(v, input.RecoveryCode)
+	}
+
+	if !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("verifying second factor")
+	ok, err := app.verifySecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.invalidMFACodeResponse(w, r)
+		return
+	}
+
+	span.AddEvent("deleting enrolment")
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "two-factor authentication disabled successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *Application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	_, span := app.config.tracer.Start(r.Context(), "regenerate recovery codes")
+	defer span.End()
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	span.AddEvent("reading request data and validating")
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.faildValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	span.AddEvent("verifying totp code")
+	ok, err := app.verifySecondFactor(user.ID, input.Code, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.invalidMFACodeResponse(w, r)
+		return
+	}
+
+	span.AddEvent("generating recovery codes")
+	codes, err := app.models.TOTP.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	span.AddEvent("sending response")
+	err = app.writeJson(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
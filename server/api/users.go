@@ -7,12 +7,13 @@ import (
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/mahmoud-shabban/greenlight/internal/data"
+	"github.com/mahmoud-shabban/greenlight/internal/mailer"
 	"github.com/mahmoud-shabban/greenlight/internal/validator"
 )
 
 func (app *Application) registerUserHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 
-	ctx, span := app.config.tracer.Start(r.Context(), "register user")
+	_, span := app.config.tracer.Start(r.Context(), "register user")
 	defer span.End()
 	var input struct {
 		Name     string `json:"name"`
@@ -32,6 +33,7 @@ func (app *Application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Name:      input.Name,
 		Email:     input.Email,
 		Activated: false,
+		Language:  mailer.PreferredLanguage(r.Header.Get("Accept-Language")),
 	}
 
 	span.AddEvent("setting user password")
@@ -43,13 +45,15 @@ func (app *Application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
+	app.passwordPolicy.Validate(v, input.Password, input.Name, input.Email)
+
 	if data.ValidateUser(v, user); !v.Valid() {
 		app.faildValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	span.AddEvent("inser user into database")
-	err = app.models.Users.Insert(user)
+	span.AddEvent("inserting user, activation token and welcome email into database")
+	_, err = app.models.Users.Register(user, app.config.auth.defaultRole, 3*24*time.Hour, "user_welcome.tmpl.html")
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDublicateEmail):
@@ -61,33 +65,6 @@ func (app *Application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	span.AddEvent("setting user permission in database")
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	span.AddEvent("create and sending activation token")
-	token, err := app.models.Tokens.New(ctx, user.ID, 3*24*time.Hour, data.ScopeActivation, app.config.tracer)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	app.background(func() {
-		span.AddEvent("background task: sending activation mail")
-		data := map[string]any{
-			"userID":          user.ID,
-			"activationToken": token.Plaintext,
-		}
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl.html", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
-
-	})
-
 	span.AddEvent("sending response")
 	err = app.writeJson(w, http.StatusAccepted, envelope{"user": user}, nil)
 